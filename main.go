@@ -13,6 +13,22 @@
 //	    sudo ./ffgestures -c=config.json
 //	To print the version:
 //	    ./ffgestures -v
+//	To print the effective configuration as JSON:
+//	    ./ffgestures -c=config.json -print-config
+//	To run a synthesized gesture through detection and dispatch:
+//	    ./ffgestures -c=config.json -simulate=3swipe_up
+//	To print detected gestures for a shell pipeline instead of running actions:
+//	    ./ffgestures -c=config.json -emit | while read key count dx dy; do ...; done
+//	To check the commands of actions marked "verify" (they see FFGESTURE_VERIFY=1):
+//	    ./ffgestures -c=config.json -verify-actions
+//	To read touchscreens through evdev instead of libinput:
+//	    sudo ./ffgestures -c=config.json -backend=evdev
+//	To check captured streams against their expected gestures:
+//	    ./ffgestures -c=config.json -replay=testdata/replay
+//	To wait for one gesture in a script:
+//	    key=$(./ffgestures -c=config.json -once -emit | cut -d' ' -f1)
+//	To see how a debug-events line is parsed:
+//	    libinput debug-events | ./ffgestures -debug-parser=-
 //
 // Build with:
 //
@@ -21,40 +37,93 @@ package main
 
 import (
 	"bufio"
+	"bytes"
+	"cmp"
+	"context"
+	"crypto/sha256"
+	"encoding/binary"
+	"encoding/csv"
+	"encoding/hex"
 	"encoding/json"
 	"flag"
 	"fmt"
+	"io"
+	"maps"
 	"math"
+	"net"
+	"net/http"
 	"os"
 	"os/exec"
 	"os/signal"
+	"path/filepath"
+	"reflect"
 	"regexp"
+	"runtime"
+	"slices"
+	"sort"
 	"strconv"
 	"strings"
+	"sync"
+	"sync/atomic"
 	"syscall"
 	"time"
+	"unicode"
+	"unsafe"
 )
 
 // ------------------ Logging ------------------
 
+// logOutput is where Log writes. Modes that print machine-readable output on
+// stdout redirect it to stderr.
+var logOutput io.Writer = os.Stdout
+
+// logLevels lists the log levels from most to least verbose.
+var logLevels = []string{"debug", "info", "warn", "error"}
+
+// logLevelOverride holds the level set at runtime by a "setLogLevel" action,
+// or "" to use the configured level.
+var logLevelOverride atomic.Value
+
+// currentLogLevel returns the minimum level that is logged: the runtime
+// override if set, otherwise config.LogLevel, otherwise "debug" or "info"
+// depending on config.Debug.
+func currentLogLevel() string {
+	if level, _ := logLevelOverride.Load().(string); level != "" {
+		return level
+	}
+	cfg := liveConfig()
+	if cfg.LogLevel != "" {
+		return cfg.LogLevel
+	}
+	if cfg.Debug {
+		return "debug"
+	}
+	return "info"
+}
+
+// logEnabled reports whether messages of the given level are logged.
+func logEnabled(level string) bool {
+	return slices.Index(logLevels, level) >= slices.Index(logLevels, currentLogLevel())
+}
+
 // Log prints a message with the specified level and a timestamp.
 // Available levels: "info", "error", "warn", "debug".
-// If the level is "debug" and config.Debug is false, the message is suppressed.
+// Messages below the current log level are suppressed.
 func Log(level, msg string) {
-	if level == "debug" && !config.Debug {
+	if !logEnabled(level) {
 		return
 	}
 	switch level {
 	case "info":
-		fmt.Printf("\x1b[32m%s [INFO] %s\x1b[0m\n", time.Now().Format("15:04:05"), msg)
+		fmt.Fprintf(logOutput, "\x1b[32m%s [INFO] %s\x1b[0m\n", time.Now().Format("15:04:05"), msg)
 	case "error":
-		fmt.Printf("\x1b[31m%s [ERROR] %s\x1b[0m\n", time.Now().Format("15:04:05"), msg)
+		fmt.Fprintf(logOutput, "\x1b[31m%s [ERROR] %s\x1b[0m\n", time.Now().Format("15:04:05"), msg)
 	case "warn":
-		fmt.Printf("\x1b[33m%s [WARNING] %s\x1b[0m\n", time.Now().Format("15:04:05"), msg)
+		fmt.Fprintf(logOutput, "\x1b[33m%s [WARNING] %s\x1b[0m\n", time.Now().Format("15:04:05"), msg)
 	case "debug":
-		fmt.Printf("\x1b[36m%s [DEBUG] %s\x1b[0m\n", time.Now().Format("15:04:05"), msg)
+		fmt.Fprintf(logOutput, "\x1b[36m%s [DEBUG] %s\x1b[0m\n", time.Now().Format("15:04:05"), msg)
 	default:
-		fmt.Printf("%s [UNKNOWN] %s\n", time.Now().Format("15:04:05"), msg)
+		fmt.Fprintf(logOutput, "%s [UNKNOWN] %s\n", time.Now().Format("15:04:05"), msg)
 	}
 }
 
@@ -66,279 +135,5850 @@ const version = "ffgestures version 1.0.0"
 
 // Config holds configurable settings.
 type Config struct {
-	Threshold      float64           `json:"threshold"`
-	GestureActions map[string]string `json:"gestureActions"`
-	Debug          bool              `json:"debug"`
+	Threshold float64 `json:"threshold"`
+	// ThresholdByFingerCount overrides Threshold for specific finger counts
+	// (e.g. {"2": 8, "4": 15}).
+	ThresholdByFingerCount map[int]float64   `json:"thresholdByFingerCount"`
+	GestureActions         map[string]Action `json:"gestureActions"`
+	// Devices overrides Threshold, ThresholdByFingerCount and
+	// GestureActions for individual devices, keyed by device name (as shown
+	// by "libinput list-devices") or event node (e.g. "event11"). The
+	// "default" block is inherited by every other device block.
+	Devices map[string]DeviceConfig `json:"devices"`
+	// AdaptiveThreshold replaces Threshold with AdaptiveThresholdRatio times
+	// the average travel of the last AdaptiveThresholdWindow recognized
+	// touchscreen swipes, kept between AdaptiveThresholdMin and
+	// AdaptiveThresholdMax. Threshold applies until enough swipes were seen.
+	AdaptiveThreshold       bool    `json:"adaptiveThreshold"`
+	AdaptiveThresholdMin    float64 `json:"adaptiveThresholdMin"`
+	AdaptiveThresholdMax    float64 `json:"adaptiveThresholdMax"`
+	AdaptiveThresholdRatio  float64 `json:"adaptiveThresholdRatio"`
+	AdaptiveThresholdWindow int     `json:"adaptiveThresholdWindow"`
+	// KeyFormat is the template used to build gesture keys from the {type},
+	// {count} and {dir} fields (default "{count}{type}_{dir}", e.g.
+	// "3swipe_up").
+	KeyFormat string `json:"keyFormat"`
+	// DispatcherCommand, when set, is run for every detected gesture with the
+	// gesture as a JSON object on stdin. GestureActions become optional. The
+	// gesture counts as executed if the dispatcher exits with status 0 or its
+	// mapped action ran.
+	DispatcherCommand string `json:"dispatcherCommand"`
+	// Layers are named alternate binding sets activated by a "switchLayer"
+	// action. Gestures not bound in the active layer fall back to
+	// GestureActions.
+	Layers map[string]map[string]Action `json:"layers"`
+	// Modes maps a mode name to the gesture keys that stay enabled while that
+	// mode is active; all other gestures are disabled. Modes are toggled by
+	// "setMode" actions and persisted in StateFile.
+	Modes map[string][]string `json:"modes"`
+	// StateFile, when set, persists runtime state such as the active mode
+	// across restarts.
+	StateFile string `json:"stateFile"`
+	// LayerTimeoutMs returns to the base bindings after this many
+	// milliseconds without a gesture (0 keeps the layer until switched back).
+	LayerTimeoutMs int `json:"layerTimeoutMs"`
+	// LayerCommand runs whenever the active layer changes, e.g. to show it
+	// in a status bar. {layer} is replaced by the new layer ("" for the base
+	// bindings).
+	LayerCommand string `json:"layerCommand"`
+	// OnStartCommand runs once the configuration is loaded and input is
+	// being read, and OnStopCommand when ffgestures shuts down, for at most
+	// stopCommandTimeout.
+	OnStartCommand string `json:"onStartCommand"`
+	OnStopCommand  string `json:"onStopCommand"`
+	// InhibitWhenRunning lists process names; while any of them is running,
+	// detected gestures are logged but not executed.
+	InhibitWhenRunning []string `json:"inhibitWhenRunning"`
+	// InhibitWhenLocked logs but does not execute gestures while
+	// LockStateCommand reports the screen as locked ("locked", "yes", "true"
+	// or "1" on stdout), except those listed in AllowWhenLocked.
+	InhibitWhenLocked bool     `json:"inhibitWhenLocked"`
+	LockStateCommand  string   `json:"lockStateCommand"`
+	AllowWhenLocked   []string `json:"allowWhenLocked"`
+	// Schedule, when set, limits gesture execution to its time windows;
+	// outside them gestures are logged but not executed.
+	Schedule []ScheduleWindow `json:"schedule"`
+	// Emit prints detected gestures without a mapped action to stdout as
+	// "<key> <count> <dx> <dy>" lines for consumption by other tools.
+	Emit bool `json:"emit"`
+	// EmitFormat is the line format used by Emit: "plain" (default) for
+	// "<key> <count> <dx> <dy>" or "event" for versioned, libinput-like
+	// "GESTURE/1 swipe up 3 +12.345s dx=0.00 dy=-30.00 key=3swipe_up" lines.
+	EmitFormat string `json:"emitFormat"`
+	// EmitAll extends Emit to every detected gesture, including those whose
+	// action is executed.
+	EmitAll bool `json:"emitAll"`
+	// ScreenRotation is the clockwise rotation of the panel in degrees
+	// (0, 90, 180 or 270). Touch coordinates are rotated accordingly so that
+	// swipe directions match what the user sees.
+	ScreenRotation int `json:"screenRotation"`
+	// RotationCommand, when set, is a shell command whose output reports the
+	// current display rotation (e.g. "wlr-randr | grep Transform"). It is
+	// polled every RotationRefreshMs and overrides ScreenRotation while it
+	// succeeds.
+	RotationCommand   string `json:"rotationCommand"`
+	RotationRefreshMs int    `json:"rotationRefreshMs"`
+	// DetectRestingTap emits "tap_with_<n>_resting" when a finger is placed
+	// while n other fingers rest nearly stationary (e.g. for right-click
+	// emulation). Off by default as it is prone to false positives.
+	DetectRestingTap bool `json:"detectRestingTap"`
+	// TapMaxMs turns touches that stay below the threshold and are lifted at
+	// most this many milliseconds after the first finger landed into
+	// "<n>tap" gestures (0 disables taps).
+	TapMaxMs int `json:"tapMaxMs"`
+	// MinSamples and MinMotionEvents bound the TOUCH_MOTION updates of a
+	// gesture's fingers, counting the touch-down, so 1 never drops a gesture.
+	// MinSamples ignores gestures none of whose fingers produced that many,
+	// such as fast accidental brushes; MinMotionEvents ignores gestures any
+	// of whose fingers produced fewer, such as one landing just before the
+	// lift. They apply to swipes, two-handed swipes, pinches, rotations and
+	// paths; taps, which need not move, are exempt.
+	MinSamples      int `json:"minSamples"`
+	MinMotionEvents int `json:"minMotionEvents"`
+	// PathLengthThreshold, when greater than 0, additionally requires the
+	// fingers of a swipe to have travelled this far on average along their
+	// paths, however little of it adds up to net displacement.
+	PathLengthThreshold float64 `json:"pathLengthThreshold"`
+	// MultiTapWindowMs chains taps with the same finger count that follow
+	// each other within this many milliseconds into one "<n>tap_x<taps>"
+	// gesture, dispatched once the window passes without another tap or
+	// MultiTapMax taps were reached (0 dispatches every tap at once).
+	MultiTapWindowMs int `json:"multiTapWindowMs"`
+	MultiTapMax      int `json:"multiTapMax"`
+	// SequenceWindowMs, when greater than 0, matches gestures that follow
+	// each other within this many milliseconds against comma-separated keys
+	// such as "2tap,1swipe_up". The gesture completing a mapped sequence is
+	// dispatched as the sequence instead; the ones before it are dispatched
+	// as usual.
+	SequenceWindowMs int `json:"sequenceWindowMs"`
+	// RestingMaxTravel is how far a finger may move and still count as resting.
+	RestingMaxTravel float64 `json:"restingMaxTravel"`
+	// RestingMinFrames is how many frames a finger must have been down to
+	// count as resting.
+	RestingMinFrames int `json:"restingMinFrames"`
+	// HoldMinMs, when greater than 0, enables holds: once two or more fingers
+	// have stayed within HoldMaxTravel of where they landed for this many
+	// milliseconds, "<n>hold_begin" is dispatched, and "<n>hold_end" when
+	// one of them lifts (e.g. for push-to-talk). A hold replaces the gesture
+	// the fingers would otherwise make.
+	HoldMinMs     int     `json:"holdMinMs"`
+	HoldMaxTravel float64 `json:"holdMaxTravel"`
+	// ChordHoldMinMs, when greater than 0, enables chords: while fingers
+	// that have stayed within HoldMaxTravel for at least this many
+	// milliseconds are held, further fingers landing and lifting within
+	// ChordTapMaxMs without moving more than HoldMaxTravel dispatch
+	// "<held>hold_<taps>tap" (e.g. "2hold_1tap"). The held fingers' own
+	// gesture is discarded once a chord fired.
+	ChordHoldMinMs int `json:"chordHoldMinMs"`
+	ChordTapMaxMs  int `json:"chordTapMaxMs"`
+	// CancelOnKeyboard discards a gesture in progress when a keyboard key is
+	// pressed, to avoid accidental gestures while typing.
+	CancelOnKeyboard bool `json:"cancelOnKeyboard"`
+	// SuppressWhileDragging ignores gestures while a pointer button is held,
+	// e.g. during a drag or text selection, and discards a gesture in
+	// progress when a button is pressed.
+	SuppressWhileDragging bool `json:"suppressWhileDragging"`
+	// DisableWhileTypingMs inhibits gesture actions for this many milliseconds
+	// after a keyboard key press (0 disables).
+	DisableWhileTypingMs int `json:"disableWhileTypingMs"`
+	// MaxGestureDurationMs rejects interactions lasting longer than this as
+	// swipes (0 disables the limit).
+	MaxGestureDurationMs int `json:"maxGestureDurationMs"`
+	// LiftRatio, when greater than 0, completes a gesture as soon as at least
+	// this fraction of its fingers (e.g. 0.8) lifted within LiftWindowFrames
+	// frames; the remaining fingers complete with them where they are, and
+	// their further motion is ignored as stragglers.
+	LiftRatio        float64 `json:"liftRatio"`
+	LiftWindowFrames int     `json:"liftWindowFrames"`
+	// CompleteDelayMs waits this long after the last finger lifted before
+	// completing the gesture. A finger touching down in the meantime
+	// continues the gesture, resuming its own track if it had just lifted.
+	CompleteDelayMs int `json:"completeDelayMs"`
+	// MinFingers and MaxFingers limit the finger counts that are recognized
+	// (0 for no limit). Touches beyond MaxFingers are not tracked and
+	// discard the interaction.
+	MinFingers int `json:"minFingers"`
+	MaxFingers int `json:"maxFingers"`
+	// TouchStaleMs reaps tracked touches that have not been seen for this
+	// many milliseconds, and MaxTrackedTouches caps the number of tracked
+	// touches. Both guard against unbounded growth when a device never emits
+	// TOUCH_FRAME (0 disables either).
+	TouchStaleMs      int `json:"touchStaleMs"`
+	MaxTrackedTouches int `json:"maxTrackedTouches"`
+	// PinchThreshold is the minimum relative change in finger spread (e.g.
+	// 0.2 for 20%) for a pinch, and RotateThreshold the minimum rotation in
+	// degrees for a rotate gesture. 0 disables either.
+	PinchThreshold  float64 `json:"pinchThreshold"`
+	RotateThreshold float64 `json:"rotateThreshold"`
+	// GestureAliases renames pinch and rotate gestures in their keys, e.g.
+	// {"pinch_in": "zoom_out"} turns "2pinch_in" into "2zoom_out". The part
+	// of an alias before the first "_" replaces {type} and the rest {dir}.
+	GestureAliases map[string]string `json:"gestureAliases"`
+	// PostGestureSettleMs ignores every gesture completing within this many
+	// milliseconds of an executed gesture, whatever its finger count, to
+	// absorb fingers brushing the surface again after a swipe (0 disables).
+	PostGestureSettleMs int `json:"postGestureSettleMs"`
+	// MultiDeviceMode decides how gestures from different devices interact.
+	// Touches are always tracked per device, so fingers on two devices never
+	// form one gesture. "independent" (default) devices do not suppress each
+	// other's gestures through PostGestureSettleMs or ResidualSuppressMs,
+	// while "coalesce" merges the same gesture completing on another device
+	// within MultiDeviceWindowMs into a single execution.
+	MultiDeviceMode     string `json:"multiDeviceMode"`
+	MultiDeviceWindowMs int    `json:"multiDeviceWindowMs"`
+	// ResidualSuppressMs ignores gestures completing within this many
+	// milliseconds of an executed gesture when they match ResidualFingerRule:
+	// "fewer" (default) fingers than that gesture, "fewerOrEqual" or "any".
+	ResidualSuppressMs int    `json:"residualSuppressMs"`
+	ResidualFingerRule string `json:"residualFingerRule"`
+	// GestureVector selects how a swipe's motion is computed: "average"
+	// (default) averages each finger's travel from its touch-down to its
+	// lift, "centroid" takes the displacement of the fingers' centroid while
+	// all of them were down, "weighted" weights each finger's travel by its
+	// length so that fingers that barely moved count for little.
+	GestureVector string `json:"gestureVector"`
+	// FingerPositions numbers the fingers of touchscreen gestures left to
+	// right by where they landed (top to bottom on ties) and passes each
+	// finger's start and travel to actions as finger<n>_x, finger<n>_y,
+	// finger<n>_dx and finger<n>_dy.
+	FingerPositions bool `json:"fingerPositions"`
+	// SpeedZones, when set, bands swipes by their speed (average travel per
+	// second in device coordinates, 0-100 per axis). A swipe falls into the
+	// zone with the highest Min it reaches and is keyed "<key>@<zone>",
+	// e.g. "3swipe_up@fast", if that key is mapped, and "<key>" otherwise.
+	SpeedZones []SpeedZone `json:"speedZones"`
+	// PathCornerAngle, when greater than 0, splits the path of the finger
+	// that travelled furthest into legs wherever its heading turns by at
+	// least this many degrees. Paths with two or more legs of at least
+	// PathMinLeg become "<n>path_<dir1>_<dir2>..." gestures, e.g.
+	// "1path_down_right" for an L.
+	PathCornerAngle float64 `json:"pathCornerAngle"`
+	PathMinLeg      float64 `json:"pathMinLeg"`
+	// EdgeMargin is the distance from a border (in device coordinates,
+	// 0-100) within which a swipe toward that border ends as a swipe off the
+	// edge, keyed "<n>swipeoff_<dir>" (e.g. "3swipeoff_right"). Swipes off
+	// the edge are only recognized when their key is mapped.
+	EdgeMargin float64 `json:"edgeMargin"`
+	// ClusterDistance, when greater than 0, enables two-handed gestures:
+	// fingers starting within this distance of each other form a hand, and
+	// touches forming exactly two hands produce keys such as
+	// "2+2swipe_apart", built with KeyFormat after the "<left>+".
+	ClusterDistance float64 `json:"clusterDistance"`
+	// SplitDistance, when greater than 0, splits the touches of a completed
+	// gesture into groups of fingers starting within this distance of each
+	// other and classifies each group as a gesture of its own, so that two
+	// unrelated touches finishing together are not averaged into one. Split
+	// groups never form two-handed gestures.
+	SplitDistance float64 `json:"splitDistance"`
+	// WholeHandFingers, when greater than 0, exempts touches with at least
+	// this many fingers from the heuristics tuned for a few fingers: resting
+	// tap detection, LiftRatio straggler dropping, two-handed clustering,
+	// SplitDistance and MaxSpread.
+	WholeHandFingers int `json:"wholeHandFingers"`
+	// MaxSpread, when greater than 0, ignores touches of two or more fingers
+	// whose average distance between each pair of fingers where they landed
+	// exceeds it, as a palm resting flat is likely.
+	MaxSpread float64 `json:"maxSpread"`
+	// DirectionHysteresis, in degrees, makes the swipe direction sticky: it
+	// is evaluated every frame, and once chosen it only changes when the
+	// movement is more than half this band past the 45 degree boundary. The
+	// final direction is taken from this tracking too. 0 (default) disables.
+	DirectionHysteresis float64 `json:"directionHysteresis"`
+	// SnapToNearest dispatches an unmapped swipe as the mapped swipe with the
+	// same finger count whose direction is closest to the movement (within
+	// 90 degrees).
+	SnapToNearest bool `json:"snapToNearest"`
+	// DisabledDirections lists swipe directions ("left", "right", "up",
+	// "down") that are ignored, e.g. to work around unreliable hardware.
+	DisabledDirections []string `json:"disabledDirections"`
+	// GestureLogCSV, when set, is a CSV file to which every detected gesture
+	// is appended for later analysis.
+	GestureLogCSV string `json:"gestureLogCSV"`
+	// RawLinesPath, when set, is a file to which every detected gesture is
+	// appended together with the raw debug-events lines it was detected
+	// from, e.g. to build a training dataset. "-" writes to stdout.
+	RawLinesPath string `json:"rawLinesPath"`
+	// FeedbackSound is a sound file played with SoundPlayer as soon as a
+	// gesture with an action is recognized, before the action runs.
+	FeedbackSound string `json:"feedbackSound"`
+	// KeyTool is the command (with optional arguments) used by "key" steps;
+	// the key combination is appended as the last argument.
+	KeyTool string `json:"keyTool"`
+	// SoundPlayer is the command (with optional arguments) used to play
+	// action sounds; the sound file is appended as the last argument.
+	SoundPlayer string `json:"soundPlayer"`
+	// ScreenMapping, when set, maps device coordinates to screen pixels so
+	// that actions receive the gesture's start and end in screen space.
+	ScreenMapping *ScreenMapping `json:"screenMapping"`
+	// LearningMode records every completed interaction and, on exit, logs
+	// statistics with recommended threshold and duration settings.
+	// LearningOutput optionally receives them as a config snippet.
+	LearningMode   bool   `json:"learningMode"`
+	LearningOutput string `json:"learningOutput"`
+	// LogLatency logs at debug level how long it took from a gesture's last
+	// input event to its command being started, and how much of that passed
+	// before the gesture was detected.
+	LogLatency bool `json:"logLatency"`
+	// InitialEventTimeoutMs warns once if no input event has been received
+	// this long after startup (0 disables).
+	InitialEventTimeoutMs int `json:"initialEventTimeoutMs"`
+	// IdleReportIntervalMs logs a heartbeat every time this long passes
+	// without a detected gesture while input events are still arriving
+	// (0 disables).
+	IdleReportIntervalMs int `json:"idleReportIntervalMs"`
+	// EventSilenceWarnMs warns when no input event has been received for
+	// this long after the first one, e.g. because the device disappeared
+	// (0 disables).
+	EventSilenceWarnMs int `json:"eventSilenceWarnMs"`
+	// PermissionHint is logged with the error when libinput reports on
+	// stderr that it cannot open the input devices.
+	PermissionHint string `json:"permissionHint"`
+	// ScannerBufferSize is the maximum length in bytes of a libinput output
+	// line (minimum 64 KiB).
+	ScannerBufferSize int `json:"scannerBufferSize"`
+	// DetectDevices queries "libinput list-devices" at startup and handles
+	// touchscreens through TOUCH events and touchpads through libinput's
+	// native GESTURE_SWIPE events. When disabled or when detection fails,
+	// every device is treated as a touchscreen.
+	DetectDevices bool `json:"detectDevices"`
+	// IgnoredDevices drops all events from matching devices: an entry
+	// matches a device node (e.g. "event11") exactly or is a substring of
+	// the device name.
+	IgnoredDevices []string `json:"ignoredDevices"`
+	// Backend selects how touch input is read: "libinput" parses the output
+	// of "libinput debug-events", "evdev" reads multi-touch events from the
+	// kernel's /dev/input/event* nodes directly. Devices entries may set
+	// their own backend. Takes effect at startup.
+	Backend string `json:"backend"`
+	// EnableTablet recognizes pen strokes from tablet tool (stylus) events as
+	// "pen" swipes of at least TabletThreshold millimeters. The peak pressure
+	// is bucketed by TabletPressureLevels (ascending thresholds between 0 and
+	// 1) and appended to the key as "_p<level>", e.g. "1pen_right_p1".
+	EnableTablet         bool      `json:"enableTablet"`
+	TabletThreshold      float64   `json:"tabletThreshold"`
+	TabletPressureLevels []float64 `json:"tabletPressureLevels"`
+	// ControlAddr, when set, serves the HTTP control API on this address
+	// (e.g. ":7117"). A missing host binds to localhost.
+	ControlAddr string `json:"controlAddr"`
+	// Precision is the number of decimals used for coordinates and deltas in
+	// logs and in {dx}/{dy} template substitution.
+	Precision int `json:"precision"`
+	// LogLevel is the minimum level logged: "debug", "info", "warn" or
+	// "error". When empty, Debug selects "debug" or "info".
+	LogLevel string `json:"logLevel"`
+	Debug    bool   `json:"debug"`
+
+	// keyToolErr is why KeyTool cannot be run, or nil if it can. "key"
+	// steps fall back to their Command while it is set.
+	keyToolErr error
 }
 
+// defaultKeyFormat produces keys such as "3swipe_up".
+const defaultKeyFormat = "{count}{type}_{dir}"
+
+// keyFormatFields are the placeholders allowed in KeyFormat.
+var keyFormatFields = []string{"type", "count", "dir"}
+
 // Global configuration. Defaults are provided and will be overridden
-// if a config file is found.
-var config = Config{
-	Threshold: 10.0,
-	GestureActions: map[string]string{
-		"3swipe_left":  "echo '3-finger swipe left action executed'",
-		"3swipe_right": "echo '3-finger swipe right action executed'",
-		"3swipe_up":    "echo '3-finger swipe up action executed'",
-		"3swipe_down":  "echo '3-finger swipe down action executed'",
-	},
-	Debug: true,
+// if a config file is found. It belongs to the event loop: it is replaced
+// under eventMu, so code that may run elsewhere uses liveConfig instead.
+var config = defaultConfig()
+
+// sharedConfig is a copy of config published by publishConfig for command
+// goroutines, logging and other code running without eventMu. The Config it
+// points to is never modified.
+var sharedConfig atomic.Pointer[Config]
+
+// publishConfig makes the current config visible to liveConfig.
+func publishConfig() {
+	c := config
+	sharedConfig.Store(&c)
 }
 
-// ------------------ Touch Tracking ------------------
+// liveConfig returns the configuration for code that may run outside the
+// event loop.
+func liveConfig() *Config {
+	if c := sharedConfig.Load(); c != nil {
+		return c
+	}
+	// Nothing runs concurrently before the configuration is first published.
+	return &config
+}
 
-// TouchPoint holds per-finger state: its starting coordinates and last known coordinates.
-type TouchPoint struct {
-	id             int
-	startX, startY float64
-	lastX, lastY   float64
+// configPath is the configuration file given on the command line.
+var configPath string
+
+// defaultConfig returns the built-in default configuration.
+func defaultConfig() Config {
+	return Config{
+		Threshold:               10.0,
+		MinSamples:              1,
+		MinMotionEvents:         1,
+		AdaptiveThresholdMin:    5,
+		AdaptiveThresholdMax:    30,
+		AdaptiveThresholdRatio:  0.5,
+		AdaptiveThresholdWindow: 20,
+		KeyFormat:               defaultKeyFormat,
+		GestureActions: map[string]Action{
+			"3swipe_left":  {Command: "echo '3-finger swipe left action executed'"},
+			"3swipe_right": {Command: "echo '3-finger swipe right action executed'"},
+			"3swipe_up":    {Command: "echo '3-finger swipe up action executed'"},
+			"3swipe_down":  {Command: "echo '3-finger swipe down action executed'"},
+		},
+		RestingMaxTravel:      2.0,
+		RestingMinFrames:      3,
+		HoldMaxTravel:         3.0,
+		ChordTapMaxMs:         250,
+		LiftWindowFrames:      1,
+		TouchStaleMs:          10000,
+		MaxTrackedTouches:     64,
+		RotationRefreshMs:     5000,
+		LockStateCommand:      `loginctl show-session "${XDG_SESSION_ID:-auto}" -p LockedHint --value`,
+		PostGestureSettleMs:   150,
+		MultiDeviceWindowMs:   200,
+		MultiTapMax:           4,
+		PathMinLeg:            10,
+		EdgeMargin:            5,
+		SoundPlayer:           "paplay",
+		KeyTool:               "xdotool key",
+		ScannerBufferSize:     1024 * 1024,
+		DetectDevices:         true,
+		Backend:               "libinput",
+		TabletThreshold:       10,
+		TabletPressureLevels:  []float64{0.5},
+		InitialEventTimeoutMs: 30000,
+		PermissionHint:        "add your user to the 'input' group or run with sudo",
+		Precision:             2,
+		Debug:                 true,
+	}
 }
 
-// Global state for tracking touches.
-var (
-	// activeTouches tracks currently active touches by finger ID.
-	activeTouches = make(map[int]*TouchPoint)
-	// finishedTouchesMap holds finished touches (deduplicated by finger ID).
-	finishedTouchesMap = make(map[int]*TouchPoint)
-	// currentFrameUpdated tracks which finger IDs updated in the current frame.
-	currentFrameUpdated = make(map[int]bool)
-)
+// DeviceConfig holds per-device overrides. Unset fields fall back to the
+// "default" device block, then to the top-level settings.
+type DeviceConfig struct {
+	Threshold              float64           `json:"threshold,omitempty"`
+	ThresholdByFingerCount map[int]float64   `json:"thresholdByFingerCount,omitempty"`
+	GestureActions         map[string]Action `json:"gestureActions,omitempty"`
+	Backend                string            `json:"backend,omitempty"`
+	MaxSpread              float64           `json:"maxSpread,omitempty"`
+}
 
-// ------------------ Event Parsing ------------------
+// defaultDeviceBlock names the Devices entry inherited by the others.
+const defaultDeviceBlock = "default"
 
-// Regular expressions to parse libinput debug-events output.
-// We are only interested in TOUCH_MOTION events.
-// Example line:
-//
-//	" event11  TOUCH_MOTION            +37.797s	1 (1) 26.98/42.53 (61.39/58.07mm)"
-var touchEventRegex = regexp.MustCompile(`^\s*(\S+)\s+(TOUCH_MOTION)\s+\+[\d.]+s\s+(\d+)(?:\s+\(\d+\))?(?:\s+([\d.]+)/([\d.]+))?`)
+// ScheduleWindow is a daily time window in local time. Start and End are
+// "HH:MM" ("24:00" is allowed for End); an End not after Start runs past
+// midnight into the next day. Days restricts the window to the days it
+// starts on ("mon" to "sun"); empty means every day.
+type ScheduleWindow struct {
+	Days  []string `json:"days,omitempty"`
+	Start string   `json:"start"`
+	End   string   `json:"end"`
+}
 
-// touchFrameRegex matches TOUCH_FRAME events.
-var touchFrameRegex = regexp.MustCompile(`^\s*(\S+)\s+TOUCH_FRAME\s+\+[\d.]+s`)
+// SpeedZone is a named speed band of SpeedZones that starts at Min.
+type SpeedZone struct {
+	Name string  `json:"name"`
+	Min  float64 `json:"min"`
+}
 
-// ------------------ Main ------------------
+// ScreenMapping translates device coordinates (0-100 on each axis) to screen
+// coordinates: screen = offset + device * scale.
+type ScreenMapping struct {
+	OffsetX float64 `json:"offsetX"`
+	OffsetY float64 `json:"offsetY"`
+	ScaleX  float64 `json:"scaleX"`
+	ScaleY  float64 `json:"scaleY"`
+}
 
-func main() {
-	// Define flags.
-	var configPath string
-	flag.StringVar(&configPath, "config", "config.json", "Path to configuration file")
-	flag.StringVar(&configPath, "c", "config.json", "Path to configuration file (alias)")
-	verFlag := flag.Bool("v", false, "Print version and exit")
-	verFlagLong := flag.Bool("version", false, "Print version and exit")
-	flag.Parse()
+// Action is what a gesture is bound to. In JSON it is either a plain shell
+// command string or an object such as {"type": "switchLayer", "layer": "media"}.
+type Action struct {
+	// Type selects the kind of action: "" or "shell" runs Command,
+	// "switchLayer" activates Layer ("" returns to the base bindings),
+	// "pushLayer" activates Layer for the next gesture only, "setMode"
+	// toggles Mode, "setLogLevel" changes the log level to Level ("" returns
+	// to the configured level), "fifo" writes Message as a line to the named
+	// pipe Fifo and "reloadConfig" reloads the configuration like SIGHUP.
+	Type    string `json:"type,omitempty"`
+	Command string `json:"command,omitempty"`
+	Layer   string `json:"layer,omitempty"`
+	// LayerTimeoutMs is how long a layer activated by "pushLayer" waits for
+	// the next gesture (0 means the global LayerTimeoutMs).
+	LayerTimeoutMs int    `json:"layerTimeoutMs,omitempty"`
+	Mode           string `json:"mode,omitempty"`
+	Level          string `json:"level,omitempty"`
+	Fifo           string `json:"fifo,omitempty"`
+	// Message is the template written by "fifo" actions (default "{key}").
+	Message string `json:"message,omitempty"`
+	// RetryCount re-runs a failing command up to this many times, waiting
+	// RetryDelayMs between attempts. TimeoutMs limits the time spent on the
+	// command, including all retries (0 means no limit).
+	RetryCount   int `json:"retryCount,omitempty"`
+	RetryDelayMs int `json:"retryDelayMs,omitempty"`
+	TimeoutMs    int `json:"timeoutMs,omitempty"`
+	// MinIntervalMs drops the gesture if it fires again within this many
+	// milliseconds of the last time its action ran.
+	MinIntervalMs int `json:"minIntervalMs,omitempty"`
+	// BusyGraceMs, when greater than 0, drops the gesture while the command
+	// of its last run is still running and for BusyGraceMs after it exits,
+	// so that the cooldown scales with the command's runtime.
+	BusyGraceMs int `json:"busyGraceMs,omitempty"`
+	// RequireConfirm only runs the action when the gesture is repeated within
+	// ConfirmWindowMs (default 2000). The first detection arms it and runs
+	// ConfirmCommand, if set, e.g. to show a notification.
+	RequireConfirm  bool   `json:"requireConfirm,omitempty"`
+	ConfirmWindowMs int    `json:"confirmWindowMs,omitempty"`
+	ConfirmCommand  string `json:"confirmCommand,omitempty"`
+	// Verify lets -verify-actions run the action's commands. Actions without
+	// it are listed as skipped, as their commands may not be safe to run.
+	Verify bool `json:"verify,omitempty"`
+	// FeedbackSound overrides the global FeedbackSound for this gesture
+	// ("off" disables it).
+	FeedbackSound string `json:"feedbackSound,omitempty"`
+	// Sound is a sound file played with SoundPlayer when the action runs.
+	Sound string `json:"sound,omitempty"`
+	// Toggle cycles through these commands instead of Command, running the
+	// next one each time the gesture fires (e.g. play, then pause).
+	Toggle []string `json:"toggle,omitempty"`
+	// Commands runs several commands in order instead of Command. Each step
+	// may be conditioned on the exit status of the previous one.
+	Commands []Step `json:"commands,omitempty"`
+	// Env sets environment variables for the action's commands, overriding
+	// the FFGESTURE_* variables and the inherited environment.
+	Env map[string]string `json:"env,omitempty"`
+	// Async set to false runs the action's commands inline, blocking event
+	// processing until they finish. Unset or true runs them in the
+	// background.
+	Async *bool `json:"async,omitempty"`
+}
 
-	// If version flag is set, print version and exit.
-	if *verFlag || *verFlagLong {
-		fmt.Println(version)
-		os.Exit(0)
-	}
+// Step is one sub-action of a composite action. In JSON it is either a shell
+// command string or an object such as {"command": "...", "when": "onSuccess"}.
+type Step struct {
+	// Type is "shell" (the default) to run Command, "dbus" to call Method on
+	// Dest at Path with Args via dbus-send, "key" to send Keys with KeyTool
+	// (or run Command instead if KeyTool is unavailable), or "sound" to play
+	// Sound.
+	Type    string   `json:"type,omitempty"`
+	Command string   `json:"command,omitempty"`
+	Dest    string   `json:"dest,omitempty"`
+	Path    string   `json:"path,omitempty"`
+	Method  string   `json:"method,omitempty"`
+	Args    []string `json:"args,omitempty"`
+	Keys    string   `json:"keys,omitempty"`
+	Sound   string   `json:"sound,omitempty"`
+	// When is "always" (the default), "onSuccess" or "onFailure", evaluated
+	// against the previous step. The first step treats its predecessor as
+	// successful.
+	When string `json:"when,omitempty"`
+	// TimeoutMs kills the step if it runs longer than this (0 means no limit).
+	TimeoutMs int `json:"timeoutMs,omitempty"`
+}
 
-	// Check that "libinput" command is available.
-	if _, err := exec.LookPath("libinput"); err != nil {
-		Log("error", "libinput command not found. Please install libinput before running this tool.")
-		os.Exit(1)
+// UnmarshalJSON accepts either a command string or a step object.
+func (s *Step) UnmarshalJSON(data []byte) error {
+	var command string
+	if err := json.Unmarshal(data, &command); err == nil {
+		*s = Step{Command: command}
+		return nil
+	}
+	type plain Step
+	var p plain
+	if err := json.Unmarshal(data, &p); err != nil {
+		return err
 	}
+	*s = Step(p)
+	return nil
+}
 
-	// Load configuration from file if available.
-	if file, err := os.Open(configPath); err == nil {
-		defer file.Close()
-		decoder := json.NewDecoder(file)
-		if err := decoder.Decode(&config); err != nil {
-			Log("error", fmt.Sprintf("Error decoding config file: %v", err))
-		} else {
-			Log("info", fmt.Sprintf("Loaded config from %s", configPath))
-		}
-	} else {
-		Log("warn", fmt.Sprintf("Could not open config file %s, using default configuration", configPath))
+// UnmarshalJSON accepts either a command string or an action object.
+func (a *Action) UnmarshalJSON(data []byte) error {
+	var command string
+	if err := json.Unmarshal(data, &command); err == nil {
+		*a = Action{Command: command}
+		return nil
 	}
+	type plain Action
+	var p plain
+	if err := json.Unmarshal(data, &p); err != nil {
+		return err
+	}
+	*a = Action(p)
+	return nil
+}
 
-	if config.Debug {
-		Log("debug", "Debug mode is enabled")
+// MarshalJSON writes plain shell actions back as command strings.
+func (a Action) MarshalJSON() ([]byte, error) {
+	if reflect.DeepEqual(a, Action{Command: a.Command}) {
+		return json.Marshal(a.Command)
 	}
+	type plain Action
+	return json.Marshal(plain(a))
+}
 
-	// Start "libinput debug-events" as an external command.
-	cmd := exec.Command("libinput", "debug-events")
-	stdout, err := cmd.StdoutPipe()
+// configSources lists the configuration sources that were loaded, in order.
+var configSources []string
+
+// loadConfig decodes the configuration file at path over the current config
+// and reports whether it was loaded. A missing file leaves the defaults in
+// place.
+func loadConfig(path string) bool {
+	if isConfigURL(path) {
+		data, _, ok := fetchConfig(path)
+		return ok && decodeConfig(path, bytes.NewReader(data))
+	}
+	file, err := os.Open(path)
 	if err != nil {
-		Log("error", fmt.Sprintf("Error creating stdout pipe: %v", err))
-		os.Exit(1)
+		Log("warn", fmt.Sprintf("Could not open config file %s, using default configuration", path))
+		return false
 	}
-	if err := cmd.Start(); err != nil {
-		Log("error", fmt.Sprintf("Error starting libinput debug-events: %v", err))
-		os.Exit(1)
+	defer file.Close()
+	return decodeConfig(path, file)
+}
+
+// decodeConfig decodes the configuration read from r over the current
+// config and records path as its source.
+func decodeConfig(path string, r io.Reader) bool {
+	if err := json.NewDecoder(r).Decode(&config); err != nil {
+		Log("error", fmt.Sprintf("Error decoding config file: %v", err))
+		return false
 	}
+	configSources = append(configSources, path)
+	Log("info", fmt.Sprintf("Loaded config from %s", path))
+	return true
+}
 
-	// Handle SIGINT/SIGTERM for graceful shutdown.
-	sigs := make(chan os.Signal, 1)
-	signal.Notify(sigs, syscall.SIGINT, syscall.SIGTERM)
-	go func() {
-		<-sigs
-		Log("info", "Terminating...")
-		cmd.Process.Kill()
-		os.Exit(0)
-	}()
+// configFetchTimeout bounds fetching a remote configuration.
+const configFetchTimeout = 10 * time.Second
 
-	// Process libinput output line by line.
-	scanner := bufio.NewScanner(stdout)
-	for scanner.Scan() {
-		line := scanner.Text()
-		if config.Debug {
-			Log("debug", fmt.Sprintf("Raw line: %s", line))
+// maxRemoteConfigSize bounds the size of a remote configuration.
+const maxRemoteConfigSize = 1 << 20
+
+// isConfigURL reports whether the config path is an http(s) URL to fetch
+// the configuration from.
+func isConfigURL(path string) bool {
+	return strings.HasPrefix(path, "http://") || strings.HasPrefix(path, "https://")
+}
+
+// remoteConfigCache returns the file in which the last good copy of the
+// configuration at url is cached, with its ETag in a ".etag" sidecar, or ""
+// if there is no cache directory.
+func remoteConfigCache(url string) string {
+	dir, err := os.UserCacheDir()
+	if err != nil {
+		return ""
+	}
+	sum := sha256.Sum256([]byte(url))
+	return filepath.Join(dir, "ffgestures", "config-"+hex.EncodeToString(sum[:8])+".json")
+}
+
+// fetchConfig fetches the configuration at url, sending the ETag of the
+// cached copy so that an unchanged configuration is not downloaded again.
+// A configuration that is fetched and decodes is cached; if fetching fails
+// or the response does not decode, the cached copy is used instead. It
+// returns the configuration, whether it differs from the cached copy, and
+// whether any configuration is available.
+func fetchConfig(url string) ([]byte, bool, bool) {
+	cache := remoteConfigCache(url)
+	var cached []byte
+	var etag string
+	if cache != "" {
+		cached, _ = os.ReadFile(cache)
+		if tag, err := os.ReadFile(cache + ".etag"); err == nil {
+			etag = strings.TrimSpace(string(tag))
 		}
-		processLine(line)
 	}
-	if err := scanner.Err(); err != nil {
-		Log("error", fmt.Sprintf("Error reading libinput output: %v", err))
-		os.Exit(1)
+	fallback := func(reason string) ([]byte, bool, bool) {
+		if cached == nil {
+			Log("warn", fmt.Sprintf("Could not fetch config from %s (%s) and there is no cached copy, using default configuration", url, reason))
+			return nil, false, false
+		}
+		Log("warn", fmt.Sprintf("Could not fetch config from %s (%s), using the cached copy %s", url, reason, cache))
+		return cached, false, true
 	}
-	if err := cmd.Wait(); err != nil {
-		Log("warn", fmt.Sprintf("libinput debug-events terminated with error: %v", err))
+
+	ctx, cancel := context.WithTimeout(context.Background(), configFetchTimeout)
+	defer cancel()
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, url, nil)
+	if err != nil {
+		return fallback(err.Error())
+	}
+	if cached != nil && etag != "" {
+		req.Header.Set("If-None-Match", etag)
+	}
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		return fallback(err.Error())
 	}
+	defer resp.Body.Close()
+	switch resp.StatusCode {
+	case http.StatusOK:
+	case http.StatusNotModified:
+		if cached != nil {
+			Log("debug", fmt.Sprintf("Config at %s is unchanged (ETag %s)", url, etag))
+			return cached, false, true
+		}
+		return fallback(resp.Status)
+	default:
+		return fallback(resp.Status)
+	}
+	data, err := io.ReadAll(io.LimitReader(resp.Body, maxRemoteConfigSize))
+	if err != nil {
+		return fallback(err.Error())
+	}
+	var probe Config
+	if err := json.Unmarshal(data, &probe); err != nil {
+		return fallback(fmt.Sprintf("invalid config: %v", err))
+	}
+	if cache != "" {
+		saveRemoteConfig(cache, data, resp.Header.Get("ETag"))
+	}
+	return data, !bytes.Equal(data, cached), true
 }
 
-// ------------------ Event Handlers ------------------
-
-// processLine handles a single line from libinput.
-// We only process TOUCH_MOTION events; TOUCH_FRAME events are handled separately.
-func processLine(line string) {
-	// Check if this is a TOUCH_FRAME event.
-	if touchFrameRegex.MatchString(line) {
-		Log("debug", "Detected TOUCH_FRAME event")
-		processFrame()
+// saveRemoteConfig replaces the cached copy of a remote configuration and
+// its ETag.
+func saveRemoteConfig(cache string, data []byte, etag string) {
+	if err := os.MkdirAll(filepath.Dir(cache), 0755); err != nil {
+		Log("warn", fmt.Sprintf("Error creating config cache directory: %v", err))
 		return
 	}
-
-	// Attempt to match a TOUCH_MOTION event.
-	matches := touchEventRegex.FindStringSubmatch(line)
-	if len(matches) == 0 {
-		Log("debug", fmt.Sprintf("Line did not match any known pattern: %s", line))
+	tmp := cache + ".tmp"
+	if err := os.WriteFile(tmp, data, 0644); err != nil {
+		Log("warn", fmt.Sprintf("Error writing config cache %s: %v", tmp, err))
 		return
 	}
-
-	fingerID, err := strconv.Atoi(matches[3])
-	if err != nil {
-		Log("error", fmt.Sprintf("Error parsing finger ID: %v", err))
+	if err := os.Rename(tmp, cache); err != nil {
+		Log("warn", fmt.Sprintf("Error replacing config cache %s: %v", cache, err))
+		return
+	}
+	if etag == "" {
+		os.Remove(cache + ".etag")
 		return
 	}
+	if err := os.WriteFile(cache+".etag", []byte(etag), 0644); err != nil {
+		Log("warn", fmt.Sprintf("Error writing config cache %s.etag: %v", cache, err))
+	}
+}
 
-	// Parse coordinate values.
-	var x, y float64
-	if len(matches) >= 6 && matches[4] != "" && matches[5] != "" {
-		x, err = strconv.ParseFloat(matches[4], 64)
-		if err != nil {
-			Log("error", fmt.Sprintf("Error parsing x coordinate: %v", err))
+// configJSONEnv names the environment variable that may hold the whole
+// configuration as JSON, for deployments without a writable config file.
+const configJSONEnv = "FFGESTURES_CONFIG_JSON"
+
+// loadConfigEnv decodes the JSON in configJSONEnv, if set, over the current
+// config, taking precedence over the config file. It reports whether the
+// configuration was loaded.
+func loadConfigEnv() bool {
+	data, ok := os.LookupEnv(configJSONEnv)
+	if !ok {
+		return false
+	}
+	loaded := config
+	decoder := json.NewDecoder(strings.NewReader(data))
+	if err := decoder.Decode(&loaded); err != nil {
+		Log("error", fmt.Sprintf("Error decoding %s, ignoring it: %v", configJSONEnv, err))
+		return false
+	}
+	config = loaded
+	configSources = append(configSources, configJSONEnv)
+	Log("info", fmt.Sprintf("Loaded config from %s", configJSONEnv))
+	return true
+}
+
+// fetchedConfig is the result of fetchConfig, passed to reloadConfig.
+type fetchedConfig struct {
+	data        []byte
+	changed, ok bool
+}
+
+// reloadMu serializes reloads, which may fetch the configuration
+// concurrently with each other.
+var reloadMu sync.Mutex
+
+// reload reloads the configuration. A remote config file is fetched before
+// taking eventMu, which is only held to swap in the result, so that a slow
+// server cannot stall event processing. It must be called without eventMu.
+func reload() bool {
+	reloadMu.Lock()
+	defer reloadMu.Unlock()
+	var fetched fetchedConfig
+	if isConfigURL(configPath) {
+		fetched.data, fetched.changed, fetched.ok = fetchConfig(configPath)
+	}
+	eventMu.Lock()
+	defer eventMu.Unlock()
+	return reloadConfig(fetched)
+}
+
+// reloadConfig rebuilds the configuration from the defaults, the config
+// file (for a remote one, fetched), the environment and the command line.
+// If neither the file nor configJSONEnv can be loaded the previous
+// configuration is kept, as it is when a remote config file is unchanged.
+// It must be called with eventMu held.
+func reloadConfig(fetched fetchedConfig) bool {
+	previous, previousSources := config, configSources
+	config, configSources = defaultConfig(), nil
+	var fileLoaded bool
+	if isConfigURL(configPath) {
+		data, changed, ok := fetched.data, fetched.changed, fetched.ok
+		if ok && !changed && slices.Contains(previousSources, configPath) {
+			config, configSources = previous, previousSources
+			Log("info", fmt.Sprintf("Config at %s is unchanged, keeping the current configuration", configPath))
+			return true
 		}
-		y, err = strconv.ParseFloat(matches[5], 64)
-		if err != nil {
-			Log("error", fmt.Sprintf("Error parsing y coordinate: %v", err))
+		fileLoaded = ok && decodeConfig(configPath, bytes.NewReader(data))
+	} else {
+		fileLoaded = loadConfig(configPath)
+	}
+	if envLoaded := loadConfigEnv(); !fileLoaded && !envLoaded {
+		config, configSources = previous, previousSources
+		Log("error", "Config reload failed, keeping the previous configuration")
+		return false
+	}
+	applyEnvOverrides()
+	applyFlagOverrides()
+	validateConfig()
+	Log("info", "Configuration reloaded")
+	return true
+}
+
+// envPrefix prefixes environment variables that override config fields.
+const envPrefix = "FFGESTURES_"
+
+// applyEnvOverrides sets scalar (bool, number and string) config fields from
+// FFGESTURES_<FIELD> environment variables, where FIELD is the field's JSON
+// name in upper snake case (e.g. FFGESTURES_THRESHOLD,
+// FFGESTURES_MAX_GESTURE_DURATION_MS). Environment values take precedence
+// over the config file, which takes precedence over the defaults.
+func applyEnvOverrides() {
+	applied := false
+	v := reflect.ValueOf(&config).Elem()
+	for i := 0; i < v.NumField(); i++ {
+		field := v.Type().Field(i)
+		name := strings.Split(field.Tag.Get("json"), ",")[0]
+		if name == "" || name == "-" {
+			continue
+		}
+		envName := envPrefix + upperSnake(name)
+		value, ok := os.LookupEnv(envName)
+		if !ok {
+			continue
 		}
+		if err := setScalar(v.Field(i), value); err != nil {
+			Log("error", fmt.Sprintf("Ignoring %s: %v", envName, err))
+			continue
+		}
+		Log("info", fmt.Sprintf("Config %s overridden by %s", name, envName))
+		applied = true
+	}
+	if applied {
+		configSources = append(configSources, "environment")
 	}
+}
 
-	// Mark that this finger updated during the current frame.
-	currentFrameUpdated[fingerID] = true
+// backendFlag is the -backend command-line flag, or "" if not given.
+var backendFlag string
 
-	// Process the TOUCH_MOTION event.
-	// If the finger is not already active, create a new record using the current coordinates.
-	if tp, exists := activeTouches[fingerID]; exists {
-		tp.lastX = x
-		tp.lastY = y
-		Log("debug", fmt.Sprintf("TOUCH_MOTION: finger %d moved to (%.2f, %.2f)", fingerID, x, y))
-	} else {
-		tp := &TouchPoint{
-			id:     fingerID,
-			startX: x,
-			startY: y,
-			lastX:  x,
-			lastY:  y,
+// applyFlagOverrides applies configuration given on the command line, which
+// takes precedence over the config file and the environment.
+func applyFlagOverrides() {
+	if backendFlag != "" {
+		config.Backend = backendFlag
+		configSources = append(configSources, "-backend")
+	}
+}
+
+// setScalar parses value into a bool, integer, float or string field.
+func setScalar(field reflect.Value, value string) error {
+	switch field.Kind() {
+	case reflect.Bool:
+		b, err := strconv.ParseBool(value)
+		if err != nil {
+			return err
 		}
-		activeTouches[fingerID] = tp
-		Log("debug", fmt.Sprintf("TOUCH_MOTION (new): finger %d at (%.2f, %.2f)", fingerID, x, y))
+		field.SetBool(b)
+	case reflect.Int, reflect.Int64:
+		n, err := strconv.ParseInt(value, 10, 64)
+		if err != nil {
+			return err
+		}
+		field.SetInt(n)
+	case reflect.Float64:
+		f, err := strconv.ParseFloat(value, 64)
+		if err != nil {
+			return err
+		}
+		field.SetFloat(f)
+	case reflect.String:
+		field.SetString(value)
+	default:
+		return fmt.Errorf("only scalar fields can be set from the environment")
 	}
+	return nil
 }
 
-// processFrame is called whenever a TOUCH_FRAME event is received.
-// It assumes that any active touch that did not update during the current frame
-// has been lifted.
-func processFrame() {
-	// For each active touch not updated in this frame, mark it as finished.
-	for fingerID, tp := range activeTouches {
-		if _, updated := currentFrameUpdated[fingerID]; !updated {
-			finishedTouchesMap[fingerID] = tp
-			delete(activeTouches, fingerID)
-			Log("debug", fmt.Sprintf("Assuming finger %d lifted (no update in frame)", fingerID))
+// upperSnake converts a camelCase name such as "gestureLogCSV" to
+// "GESTURE_LOG_CSV".
+func upperSnake(name string) string {
+	var b strings.Builder
+	runes := []rune(name)
+	for i, r := range runes {
+		if i > 0 && unicode.IsUpper(r) &&
+			(!unicode.IsUpper(runes[i-1]) || (i+1 < len(runes) && unicode.IsLower(runes[i+1]))) {
+			b.WriteByte('_')
 		}
+		b.WriteRune(unicode.ToUpper(r))
 	}
-	// Clear the update tracker for the next frame.
-	currentFrameUpdated = make(map[int]bool)
+	return b.String()
+}
 
-	// When there are no active touches and we have finished touches, process the gesture.
-	if len(activeTouches) == 0 && len(finishedTouchesMap) > 0 {
-		var finishedTouches []*TouchPoint
-		for _, tp := range finishedTouchesMap {
-			finishedTouches = append(finishedTouches, tp)
+// effectiveConfig is the configuration in effect together with the sources
+// it was loaded from, as reported by -print-config and the control API.
+type effectiveConfig struct {
+	Sources         []string `json:"sources"`
+	LibinputVersion string   `json:"libinputVersion"`
+	// KeyInjection reports whether KeyTool is available for "key" steps.
+	KeyInjection string `json:"keyInjection"`
+	Config       Config `json:"config"`
+}
+
+// printConfig writes the effective configuration and the sources it was
+// loaded from to stdout as indented JSON.
+func printConfig() {
+	encoder := json.NewEncoder(os.Stdout)
+	encoder.SetIndent("", "  ")
+	if err := encoder.Encode(effectiveConfig{configSources, libinputVersion, keyInjectionStatus(), config}); err != nil {
+		Log("error", fmt.Sprintf("Error encoding config: %v", err))
+		os.Exit(1)
+	}
+}
+
+// validateConfig checks the loaded configuration, logging and correcting
+// invalid values.
+func validateConfig() {
+	switch config.ScreenRotation {
+	case 0, 90, 180, 270:
+	default:
+		Log("error", fmt.Sprintf("Invalid screenRotation %d (must be 0, 90, 180 or 270), using 0", config.ScreenRotation))
+		config.ScreenRotation = 0
+	}
+	validateKeyFormat()
+	if config.LogLevel != "" && !slices.Contains(logLevels, config.LogLevel) {
+		Log("error", fmt.Sprintf("Invalid logLevel %q (must be debug, info, warn or error), using info", config.LogLevel))
+		config.LogLevel = "info"
+	}
+	switch config.MultiDeviceMode {
+	case "", "independent", "coalesce":
+	default:
+		Log("error", fmt.Sprintf("Invalid multiDeviceMode %q (must be independent or coalesce), using independent", config.MultiDeviceMode))
+		config.MultiDeviceMode = "independent"
+	}
+	switch config.Backend {
+	case "", "libinput", "evdev":
+	default:
+		Log("error", fmt.Sprintf("Invalid backend %q (must be libinput or evdev), using libinput", config.Backend))
+		config.Backend = "libinput"
+	}
+	switch config.EmitFormat {
+	case "", "plain", "event":
+	default:
+		Log("error", fmt.Sprintf("Invalid emitFormat %q (must be plain or event), using plain", config.EmitFormat))
+		config.EmitFormat = "plain"
+	}
+	switch config.GestureVector {
+	case "", "average", "centroid", "weighted":
+	default:
+		Log("error", fmt.Sprintf("Invalid gestureVector %q (must be average, centroid or weighted), using average", config.GestureVector))
+		config.GestureVector = "average"
+	}
+	switch config.ResidualFingerRule {
+	case "", "fewer", "fewerOrEqual", "any":
+	default:
+		Log("error", fmt.Sprintf("Invalid residualFingerRule %q (must be fewer, fewerOrEqual or any), using fewer", config.ResidualFingerRule))
+		config.ResidualFingerRule = "fewer"
+	}
+	for _, window := range config.Schedule {
+		validateScheduleWindow(window)
+	}
+	validateGestureAliases()
+	config.SpeedZones = slices.DeleteFunc(config.SpeedZones, func(zone SpeedZone) bool {
+		if zone.Name == "" || strings.Contains(zone.Name, "@") {
+			Log("error", fmt.Sprintf("Invalid speed zone name %q, ignoring zone", zone.Name))
+			return true
+		}
+		return false
+	})
+	slices.SortStableFunc(config.SpeedZones, func(a, b SpeedZone) int { return cmp.Compare(a.Min, b.Min) })
+	for _, direction := range config.DisabledDirections {
+		switch direction {
+		case "left", "right", "up", "down":
+		default:
+			Log("warn", fmt.Sprintf("Unknown direction %q in disabledDirections", direction))
+		}
+	}
+	for key, action := range config.GestureActions {
+		validateAction(key, action)
+	}
+	inheritDeviceDefaults()
+	for name, device := range config.Devices {
+		switch device.Backend {
+		case "", "libinput", "evdev":
+		default:
+			Log("error", fmt.Sprintf("Invalid backend %q for device %s (must be libinput or evdev), using the global backend", device.Backend, name))
+			device.Backend = ""
+			config.Devices[name] = device
+		}
+		for key, action := range device.GestureActions {
+			validateAction(name+"/"+key, action)
 		}
-		processGesture(finishedTouches)
-		// Reset finished touches map for the next gesture.
-		finishedTouchesMap = make(map[int]*TouchPoint)
 	}
+	for layer, actions := range config.Layers {
+		for key, action := range actions {
+			validateAction(layer+"/"+key, action)
+		}
+	}
+	checkKeyTool()
+	publishConfig()
 }
 
-// processGesture computes the overall movement based on the finished touches.
-// It averages the deltas (last - start) for each finger and, if the movement
-// exceeds the threshold, determines the dominant swipe direction and executes
-// the corresponding command from the config.
-func processGesture(touches []*TouchPoint) {
-	count := len(touches)
-	var totalDx, totalDy float64
-	for _, tp := range touches {
-		dx := tp.lastX - tp.startX
-		dy := tp.lastY - tp.startY
-		totalDx += dx
-		totalDy += dy
+// validateKeyFormat falls back to defaultKeyFormat if KeyFormat, from the
+// config file or FFGESTURES_KEY_FORMAT, has an unknown placeholder or lacks
+// one of {count}, {type} and {dir}, which would give different gestures the
+// same key.
+func validateKeyFormat() {
+	source := "keyFormat"
+	name := envPrefix + upperSnake(source)
+	if value, ok := os.LookupEnv(name); ok && value == config.KeyFormat {
+		source = name
 	}
-	avgDx := totalDx / float64(count)
-	avgDy := totalDy / float64(count)
-	Log("info", fmt.Sprintf("Gesture completed with %d finger(s): avg dx=%.2f, avg dy=%.2f", count, avgDx, avgDy))
+	for _, m := range templateRegex.FindAllStringSubmatch(config.KeyFormat, -1) {
+		if !slices.Contains(keyFormatFields, m[1]) {
+			Log("error", fmt.Sprintf("Invalid %s %q: unknown placeholder {%s}, using %q", source, config.KeyFormat, m[1], defaultKeyFormat))
+			config.KeyFormat = defaultKeyFormat
+			return
+		}
+	}
+	for _, field := range keyFormatFields {
+		if !strings.Contains(config.KeyFormat, "{"+field+"}") {
+			Log("error", fmt.Sprintf("Invalid %s %q: needs {count}, {type} and {dir} to tell gestures apart, using %q", source, config.KeyFormat, defaultKeyFormat))
+			config.KeyFormat = defaultKeyFormat
+			return
+		}
+	}
+}
 
-	// Ignore minor movements.
-	if math.Abs(avgDx) < config.Threshold && math.Abs(avgDy) < config.Threshold {
-		Log("debug", "Movement below threshold, gesture ignored")
-		return
+// checkKeyTool looks up KeyTool, setting config.keyToolErr if it cannot be
+// run, and warns if "key" steps are configured that then fall back to their
+// shell commands.
+func checkKeyTool() {
+	config.keyToolErr = nil
+	argv := strings.Fields(config.KeyTool)
+	if len(argv) == 0 {
+		config.keyToolErr = fmt.Errorf("keyTool is empty")
+	} else if _, err := exec.LookPath(argv[0]); err != nil {
+		config.keyToolErr = err
 	}
+	if config.keyToolErr != nil && usesKeySteps() {
+		Log("warn", fmt.Sprintf("Key injection is unavailable (%v); key steps run their command instead, or fail if they have none", config.keyToolErr))
+	}
+}
 
-	// Determine the dominant swipe direction.
-	var direction string
-	if math.Abs(avgDx) > math.Abs(avgDy) {
-		if avgDx > 0 {
-			direction = "right"
-		} else {
-			direction = "left"
+// usesKeySteps reports whether any action has a "key" step.
+func usesKeySteps() bool {
+	hasKeyStep := func(actions map[string]Action) bool {
+		for _, action := range actions {
+			if slices.ContainsFunc(action.Commands, func(step Step) bool { return step.Type == "key" }) {
+				return true
+			}
 		}
-	} else {
-		if avgDy > 0 {
-			direction = "down"
-		} else {
-			direction = "up"
+		return false
+	}
+	if hasKeyStep(config.GestureActions) {
+		return true
+	}
+	for _, actions := range config.Layers {
+		if hasKeyStep(actions) {
+			return true
 		}
 	}
-	gestureKey := fmt.Sprintf("%dswipe_%s", count, direction)
-	Log("info", fmt.Sprintf("Detected gesture: %s", gestureKey))
-	if cmdStr, exists := config.GestureActions[gestureKey]; exists {
-		go executeCommand(cmdStr)
-	} else {
-		Log("warn", fmt.Sprintf("No action mapped for gesture: %s", gestureKey))
+	for _, device := range config.Devices {
+		if hasKeyStep(device.GestureActions) {
+			return true
+		}
 	}
+	return false
 }
 
-// executeCommand runs the provided shell command using "sh -c" and logs its output.
-// The command inherits the environment so that variables like XDG_RUNTIME_DIR are preserved.
-func executeCommand(command string) {
-	Log("info", fmt.Sprintf("Executing command: %s", command))
-	cmd := exec.Command("sh", "-c", command)
-	cmd.Env = os.Environ()
-	output, err := cmd.CombinedOutput()
-	if err != nil {
-		Log("error", fmt.Sprintf("Error executing command: %v\nOutput: %s", err, strings.TrimSpace(string(output))))
-	} else {
-		Log("debug", fmt.Sprintf("Command output: %s", strings.TrimSpace(string(output))))
+// keyInjectionStatus describes whether "key" steps can run, for
+// effectiveConfig.
+func keyInjectionStatus() string {
+	if config.keyToolErr != nil {
+		return fmt.Sprintf("unavailable: %v", config.keyToolErr)
+	}
+	return "available"
+}
+
+// inheritDeviceDefaults merges the "default" device block into every other
+// device block: Threshold, Backend and MaxSpread are inherited when unset, and
+// ThresholdByFingerCount and GestureActions are merged per key, with the
+// device's own entries taking precedence.
+func inheritDeviceDefaults() {
+	defaults, ok := config.Devices[defaultDeviceBlock]
+	if !ok {
+		return
+	}
+	merged := make(map[string]DeviceConfig, len(config.Devices))
+	for name, device := range config.Devices {
+		if name != defaultDeviceBlock {
+			if device.Threshold == 0 {
+				device.Threshold = defaults.Threshold
+			}
+			if device.Backend == "" {
+				device.Backend = defaults.Backend
+			}
+			if device.MaxSpread == 0 {
+				device.MaxSpread = defaults.MaxSpread
+			}
+			device.ThresholdByFingerCount = mergeMaps(defaults.ThresholdByFingerCount, device.ThresholdByFingerCount)
+			device.GestureActions = mergeMaps(defaults.GestureActions, device.GestureActions)
+		}
+		merged[name] = device
+	}
+	config.Devices = merged
+}
+
+// mergeMaps returns a new map with the entries of base overridden by those of
+// override, or nil if both are empty.
+func mergeMaps[K comparable, V any](base, override map[K]V) map[K]V {
+	if len(base) == 0 && len(override) == 0 {
+		return nil
+	}
+	merged := maps.Clone(base)
+	if merged == nil {
+		merged = make(map[K]V, len(override))
+	}
+	maps.Copy(merged, override)
+	return merged
+}
+
+// validateAction logs problems with the action bound to key.
+func validateAction(key string, action Action) {
+	if action.Type == "fifo" && action.Fifo == "" {
+		Log("warn", fmt.Sprintf("Action %s: fifo action without a fifo path", key))
+	}
+	if action.Type == "setLogLevel" && action.Level != "" && !slices.Contains(logLevels, action.Level) {
+		Log("warn", fmt.Sprintf("Action %s: unknown log level %q", key, action.Level))
+	}
+	for i, step := range action.Commands {
+		switch step.When {
+		case "", "always", "onSuccess", "onFailure":
+		default:
+			Log("warn", fmt.Sprintf("Action %s: step %d has unknown condition %q", key, i+1, step.When))
+		}
+		var missing bool
+		switch step.Type {
+		case "", "shell":
+			missing = step.Command == ""
+		case "dbus":
+			missing = step.Dest == "" || step.Path == "" || step.Method == ""
+		case "key":
+			missing = step.Keys == ""
+		case "sound":
+			missing = step.Sound == ""
+		default:
+			Log("warn", fmt.Sprintf("Action %s: step %d has unknown type %q", key, i+1, step.Type))
+		}
+		if missing {
+			Log("warn", fmt.Sprintf("Action %s: step %d is missing fields for type %q", key, i+1, step.Type))
+		}
+	}
+}
+
+// formatFloat formats v using the configured precision.
+func formatFloat(v float64) string {
+	return strconv.FormatFloat(v, 'f', liveConfig().Precision, 64)
+}
+
+// ------------------ Touch Tracking ------------------
+
+// TouchPoint holds per-finger state: its starting coordinates and last known coordinates.
+type TouchPoint struct {
+	id             int
+	startX, startY float64
+	lastX, lastY   float64
+	// startTime and lastTime are the libinput event times (in seconds) of the
+	// finger's first and latest motion.
+	startTime, lastTime float64
+	// frames counts the TOUCH_FRAMEs this finger has been active for, and
+	// samples its TOUCH_MOTION updates.
+	frames  int
+	samples int
+	// liftFrame is the frame number in which the finger was deemed lifted,
+	// and liftTime that frame's event time.
+	liftFrame int
+	liftTime  float64
+	// lastSeen is the wall-clock time of the finger's latest event.
+	lastSeen time.Time
+	// path records the finger's positions when PathCornerAngle is set.
+	path []pathPoint
+	// pathLength is the distance the finger travelled along its path.
+	pathLength float64
+}
+
+// pathPoint is a position on a finger's path.
+type pathPoint struct{ x, y float64 }
+
+// Global state for tracking touches.
+var (
+	// activeTouches tracks currently active touches of touchDevice by
+	// finger ID.
+	activeTouches = make(map[int]*TouchPoint)
+	// finishedTouchesMap holds finished touches (deduplicated by finger ID).
+	finishedTouchesMap = make(map[int]*TouchPoint)
+	// currentFrameUpdated tracks which finger IDs updated in the current frame.
+	currentFrameUpdated = make(map[int]bool)
+	// gestureCancelled is set when the gesture in progress must be discarded
+	// once all of its fingers have lifted.
+	gestureCancelled bool
+	// stragglers holds fingers still down after their gesture was completed by
+	// LiftRatio; they are ignored until they lift.
+	stragglers = make(map[int]bool)
+	// frameCount numbers TOUCH_FRAME events.
+	frameCount int
+	// currentDevice is the event node (e.g. "event11") of the device that
+	// produced the most recent touch, swipe or tablet event.
+	currentDevice string
+	// liveDirection is the direction of the gesture in progress as tracked
+	// with DirectionHysteresis, or "" before it moved past the threshold.
+	liveDirection string
+	// holdFingers is the number of fingers of the hold in progress, or 0.
+	holdFingers int
+	// centroidFingers is the number of fingers whose centroid is tracked for
+	// the "centroid" GestureVector, and centroidStart/centroidEnd the
+	// centroid when that many fingers were first down and last seen before
+	// any of them lifted. centroidFingers is 0 when nothing is tracked.
+	centroidFingers                int
+	centroidStartX, centroidStartY float64
+	centroidEndX, centroidEndY     float64
+	// lastKeyPress is when the most recent keyboard key press was seen.
+	lastKeyPress time.Time
+	// heldButtons holds the pointer buttons currently pressed, keyed by
+	// device node and button.
+	heldButtons = make(map[string]bool)
+	// completionTimer completes the gesture once CompleteDelayMs passed
+	// after its last finger lifted. It is nil when no completion is pending.
+	completionTimer *time.Timer
+)
+
+// touchState is the touch tracking state of one device. The globals above
+// hold the state of touchDevice; switchTouchDevice swaps it with that of
+// another device, so that the fingers of devices touched at the same time
+// are lifted and completed as gestures of their own, even when both number
+// them from 0.
+type touchState struct {
+	activeTouches, finishedTouchesMap                          map[int]*TouchPoint
+	currentFrameUpdated, stragglers, chordHeld                 map[int]bool
+	gestureCancelled                                           bool
+	frameCount, holdFingers, centroidFingers                   int
+	liveDirection                                              string
+	centroidStartX, centroidStartY, centroidEndX, centroidEndY float64
+	completionTimer                                            *time.Timer
+}
+
+var (
+	// touchDevice is the event node of the device whose touch state is in
+	// the globals.
+	touchDevice string
+	// savedTouchStates holds the touch state of the other devices by event
+	// node.
+	savedTouchStates = make(map[string]*touchState)
+)
+
+// switchTouchDevice makes node the current device, loading its touch state
+// into the globals after saving that of the previous one.
+func switchTouchDevice(node string) {
+	currentDevice = node
+	if node == touchDevice {
+		return
+	}
+	savedTouchStates[touchDevice] = &touchState{
+		activeTouches, finishedTouchesMap,
+		currentFrameUpdated, stragglers, chordHeld,
+		gestureCancelled,
+		frameCount, holdFingers, centroidFingers,
+		liveDirection,
+		centroidStartX, centroidStartY, centroidEndX, centroidEndY,
+		completionTimer,
+	}
+	s, ok := savedTouchStates[node]
+	if !ok {
+		s = &touchState{
+			activeTouches:       make(map[int]*TouchPoint),
+			finishedTouchesMap:  make(map[int]*TouchPoint),
+			currentFrameUpdated: make(map[int]bool),
+			stragglers:          make(map[int]bool),
+		}
+	}
+	delete(savedTouchStates, node)
+	activeTouches, finishedTouchesMap = s.activeTouches, s.finishedTouchesMap
+	currentFrameUpdated, stragglers, chordHeld = s.currentFrameUpdated, s.stragglers, s.chordHeld
+	gestureCancelled = s.gestureCancelled
+	frameCount, holdFingers, centroidFingers = s.frameCount, s.holdFingers, s.centroidFingers
+	liveDirection = s.liveDirection
+	centroidStartX, centroidStartY, centroidEndX, centroidEndY = s.centroidStartX, s.centroidStartY, s.centroidEndX, s.centroidEndY
+	completionTimer = s.completionTimer
+	touchDevice = node
+}
+
+// forEachTouchDevice calls fn with the touch state of each device in turn
+// loaded, ending with the one loaded before.
+func forEachTouchDevice(fn func()) {
+	loaded, device := touchDevice, currentDevice
+	for _, node := range append(slices.Sorted(maps.Keys(savedTouchStates)), loaded) {
+		switchTouchDevice(node)
+		fn()
+	}
+	currentDevice = device
+}
+
+// ------------------ Event Parsing ------------------
+
+// Regular expressions to parse libinput debug-events output.
+// We are only interested in TOUCH_MOTION events.
+// Example line:
+//
+//	" event11  TOUCH_MOTION            +37.797s	1 (1) 26.98/42.53 (61.39/58.07mm)"
+var touchEventRegex = regexp.MustCompile(`^\s*(\S+)\s+(TOUCH_MOTION)\s+\+([\d.]+)s\s+(\d+)(?:\s+\(\d+\))?(?:\s+([\d.]+)/([\d.]+))?`)
+
+// touchEventFormat is a variant of the TOUCH_MOTION line format printed by
+// libinput releases from minVersion on. Its regex must capture the same
+// groups as touchEventRegex.
+type touchEventFormat struct {
+	minVersion string
+	regex      *regexp.Regexp
+}
+
+// touchEventFormats lists the known TOUCH_MOTION formats, newest first. All
+// releases known so far share one format, so the table only has an entry for
+// it; add one when a libinput release changes the line format.
+var touchEventFormats = []touchEventFormat{
+	{"1.0.0", touchEventRegex},
+}
+
+// touchEventRegexes are the formats tried for TOUCH_MOTION lines: the one
+// matching the detected libinput version, or all of them if it is unknown.
+var touchEventRegexes = []*regexp.Regexp{touchEventRegex}
+
+// selectEventFormats chooses touchEventRegexes for the given libinput
+// version ("" if unknown).
+func selectEventFormats(version string) {
+	touchEventRegexes = nil
+	for _, format := range touchEventFormats {
+		if version != "" && compareVersions(version, format.minVersion) >= 0 {
+			touchEventRegexes = []*regexp.Regexp{format.regex}
+			Log("debug", fmt.Sprintf("Using libinput %s+ event format", format.minVersion))
+			return
+		}
+		touchEventRegexes = append(touchEventRegexes, format.regex)
+	}
+	Log("debug", "Unknown libinput version, trying all known event formats")
+}
+
+// touchFrameRegex matches TOUCH_FRAME events, capturing the event time.
+var touchFrameRegex = regexp.MustCompile(`^\s*(\S+)\s+TOUCH_FRAME\s+\+([\d.]+)s`)
+
+// gestureSwipeRegex matches GESTURE_SWIPE_BEGIN/UPDATE/END events emitted for
+// touchpads. Example lines:
+//
+//	" event5   GESTURE_SWIPE_BEGIN     +3.012s	3"
+//	" event5   GESTURE_SWIPE_UPDATE    +3.020s	3  0.23/ 0.45 ( 0.58/ 1.12 unaccelerated)"
+//	" event5   GESTURE_SWIPE_END       +3.100s	3 cancelled"
+var gestureSwipeRegex = regexp.MustCompile(`^\s*(\S+)\s+GESTURE_SWIPE_(BEGIN|UPDATE|END)\s+\+([\d.]+)s\s+(\d+)(?:\s+(-?[\d.]+)/\s*(-?[\d.]+))?(.*\bcancelled\b)?`)
+
+// tabletToolRegex matches TABLET_TOOL_TIP and TABLET_TOOL_AXIS lines, e.g.
+//
+//	event17  TABLET_TOOL_TIP     +2.350s	143.94*/76.47*	pressure: 0.31*	down
+//
+// and extracts the device, event, time, x/y in millimeters, pressure and, for
+// tip events, "down" or "up".
+var tabletToolRegex = regexp.MustCompile(`^\s*(\S+)\s+TABLET_TOOL_(TIP|AXIS)\s+\+([\d.]+)s\s+(-?[\d.]+)\*?/(-?[\d.]+)\*?.*?\bpressure:\s*([\d.]+)\*?(?:.*\b(down|up)\s*$)?`)
+
+// keyboardKeyRegex matches KEYBOARD_KEY press events.
+// Example line:
+//
+//	" event3   KEYBOARD_KEY            +12.345s	*** (-1) pressed"
+var keyboardKeyRegex = regexp.MustCompile(`^\s*(\S+)\s+KEYBOARD_KEY\s+\+[\d.]+s\s+.*\bpressed\b`)
+
+// pointerButtonRegex matches POINTER_BUTTON events, capturing the device,
+// the button (e.g. "BTN_LEFT") and whether it was pressed or released.
+var pointerButtonRegex = regexp.MustCompile(`^\s*(\S+)\s+POINTER_BUTTON\s+\+[\d.]+s\s+(\S+).*\b(pressed|released)\b`)
+
+// linePattern is one of the patterns processLine tries, with names for its
+// capture groups.
+type linePattern struct {
+	event  string
+	regex  *regexp.Regexp
+	groups []string
+}
+
+// linePatterns returns the patterns processLine tries, in the same order.
+func linePatterns() []linePattern {
+	patterns := []linePattern{
+		{"DEVICE_ADDED", deviceAddedRegex, []string{"device", "capabilities"}},
+		{"TOUCH_FRAME", touchFrameRegex, []string{"device", "time"}},
+		{"KEYBOARD_KEY", keyboardKeyRegex, []string{"device"}},
+		{"POINTER_BUTTON", pointerButtonRegex, []string{"device", "button", "state"}},
+		{"TABLET_TOOL", tabletToolRegex, []string{"device", "event", "time", "x", "y", "pressure", "tip"}},
+		{"GESTURE_SWIPE", gestureSwipeRegex, []string{"device", "phase", "time", "fingers", "dx", "dy", "cancelled"}},
+	}
+	for _, regex := range touchEventRegexes {
+		patterns = append(patterns, linePattern{"TOUCH_MOTION", regex, []string{"device", "type", "time", "finger", "x", "y"}})
+	}
+	return patterns
+}
+
+// runDebugParser prints how each debug-events line is parsed: the first
+// pattern matching it and the fields it extracts. source is the line, or "-"
+// to read lines from stdin.
+func runDebugParser(source string) error {
+	if source != "-" {
+		debugParseLine(source)
+		return nil
+	}
+	scanner := bufio.NewScanner(os.Stdin)
+	scanner.Buffer(make([]byte, 0, 64*1024), max(config.ScannerBufferSize, 64*1024))
+	for scanner.Scan() {
+		debugParseLine(scanner.Text())
+	}
+	return scanner.Err()
+}
+
+// debugParseLine prints how line is parsed for runDebugParser.
+func debugParseLine(line string) {
+	fmt.Printf("line: %q\n", line)
+	if fields := strings.Fields(line); len(fields) > 0 && ignoredDevice(strings.TrimPrefix(fields[0], "-")) {
+		fmt.Println("  device is in ignoredDevices, line is skipped")
+		return
+	}
+	for _, p := range linePatterns() {
+		matches := p.regex.FindStringSubmatch(line)
+		if matches == nil {
+			continue
+		}
+		fmt.Printf("  matched %s: %s\n", p.event, p.regex)
+		var fields []string
+		for i, name := range p.groups {
+			fields = append(fields, fmt.Sprintf("%s=%s", name, cmp.Or(strings.TrimSpace(matches[i+1]), "-")))
+		}
+		fmt.Printf("  %s\n", strings.Join(fields, " "))
+		return
+	}
+	fmt.Println("  no pattern matched, line is ignored")
+}
+
+// ------------------ Main ------------------
+
+func main() {
+	// Define flags.
+	flag.StringVar(&configPath, "config", "config.json", "Path or http(s) URL of the configuration file")
+	flag.StringVar(&configPath, "c", "config.json", "Path or http(s) URL of the configuration file (alias)")
+	verFlag := flag.Bool("v", false, "Print version and exit")
+	verFlagLong := flag.Bool("version", false, "Print version and exit")
+	printConfigFlag := flag.Bool("print-config", false, "Print the effective configuration as JSON and exit")
+	simulateKey := flag.String("simulate", "", "Synthesize touches for the given gesture key (e.g. 3swipe_up), run them through detection and dispatch, then exit")
+	emitFlag := flag.Bool("emit", false, "Print detected gestures to stdout instead of running their actions")
+	verifyFlag := flag.Bool("verify-actions", false, "Run the shell commands of actions with \"verify\": true with FFGESTURE_VERIFY=1, report those exiting non-zero, then exit")
+	flag.StringVar(&backendFlag, "backend", "", "Input backend: libinput (parse \"libinput debug-events\") or evdev (read /dev/input/event* directly); overrides the config file")
+	replayDir := flag.String("replay", "", "Replay the captured debug-events streams in the given directory, check the gestures they produce against their .expected files, then exit")
+	flag.BoolVar(&onceMode, "once", false, "Exit after the first detected gesture, once its action has finished")
+	debugParser := flag.String("debug-parser", "", "Show which pattern matches the given debug-events line and the fields it extracts, then exit (\"-\" reads lines from stdin)")
+	flag.Parse()
+
+	// If version flag is set, print version and exit.
+	if *verFlag || *verFlagLong {
+		fmt.Println(version)
+		os.Exit(0)
+	}
+
+	if *printConfigFlag || *replayDir != "" || *emitFlag || *verifyFlag || *debugParser != "" {
+		logOutput = os.Stderr
+	}
+	emitOnly = *emitFlag
+
+	// Load configuration from file if available, then apply environment
+	// overrides.
+	loadConfig(configPath)
+	loadConfigEnv()
+	applyEnvOverrides()
+	applyFlagOverrides()
+	validateConfig()
+	loadState()
+
+	if *printConfigFlag {
+		if _, err := exec.LookPath("libinput"); err == nil {
+			detectLibinputVersion()
+		}
+		printConfig()
+		os.Exit(0)
+	}
+
+	if *simulateKey != "" {
+		eventMu.Lock()
+		err := simulateGesture(*simulateKey)
+		eventMu.Unlock()
+		if err != nil {
+			Log("error", err.Error())
+			os.Exit(1)
+		}
+		commandsWG.Wait()
+		os.Exit(0)
+	}
+
+	if *verifyFlag {
+		if failed := verifyActions(); failed > 0 {
+			os.Exit(1)
+		}
+		os.Exit(0)
+	}
+
+	if *debugParser != "" {
+		if _, err := exec.LookPath("libinput"); err == nil {
+			detectLibinputVersion()
+			selectEventFormats(libinputVersion)
+		}
+		if err := runDebugParser(*debugParser); err != nil {
+			Log("error", fmt.Sprintf("Reading lines failed: %v", err))
+			os.Exit(1)
+		}
+		os.Exit(0)
+	}
+
+	if *replayDir != "" {
+		_, failed, err := runReplay(*replayDir)
+		if err != nil {
+			Log("error", fmt.Sprintf("Replay failed: %v", err))
+			os.Exit(1)
+		}
+		if failed > 0 {
+			os.Exit(1)
+		}
+		os.Exit(0)
+	}
+
+	// Check that "libinput" command is available.
+	useLibinput := needsLibinput()
+	if _, err := exec.LookPath("libinput"); err != nil && useLibinput {
+		Log("error", "libinput command not found. Please install libinput before running this tool.")
+		os.Exit(1)
+	}
+
+	if logEnabled("debug") {
+		Log("debug", "Debug mode is enabled")
+	}
+
+	if useLibinput {
+		detectLibinputVersion()
+		selectEventFormats(libinputVersion)
+	}
+
+	if config.RotationCommand != "" {
+		startRotationDetection()
+	}
+
+	if config.DetectDevices && useLibinput {
+		detectDevices()
+	}
+
+	if config.ControlAddr != "" {
+		startControlServer()
+	}
+
+	// Reload the configuration on SIGHUP.
+	hups := make(chan os.Signal, 1)
+	signal.Notify(hups, syscall.SIGHUP)
+	go func() {
+		for range hups {
+			reload()
+		}
+	}()
+
+	// Handle SIGINT/SIGTERM for graceful shutdown.
+	sigs := make(chan os.Signal, 1)
+	signal.Notify(sigs, syscall.SIGINT, syscall.SIGTERM)
+	go func() {
+		<-sigs
+		shutdown()
+	}()
+
+	// SIGHUP may already replace the configuration.
+	eventMu.Lock()
+	readers := startEvdevReaders()
+	eventMu.Unlock()
+	if !useLibinput {
+		if readers == 0 {
+			Log("error", "No evdev touch devices found. List them in devices with \"backend\": \"evdev\".")
+			os.Exit(1)
+		}
+		notifyReady()
+		select {}
+	}
+
+	// Process libinput output, restarting the stream if reading it fails.
+	for {
+		err := streamEvents()
+		if err == nil {
+			break
+		}
+		Log("warn", fmt.Sprintf("Error reading libinput output: %v; restarting libinput in %s", err, streamRestartDelay))
+		time.Sleep(streamRestartDelay)
+	}
+	reportLearning()
+	runStopCommand()
+}
+
+// shutdown stops libinput, runs the shutdown reports and hooks and exits.
+func shutdown() {
+	Log("info", "Terminating...")
+	sdNotify("STOPPING=1")
+	if cmd := libinputCmd.Load(); cmd != nil {
+		cmd.Process.Kill()
+	}
+	reportLearning()
+	runStopCommand()
+	os.Exit(0)
+}
+
+var (
+	// onceMode is set by -once: ffgestures exits after the first detected
+	// gesture.
+	onceMode bool
+	// onceDone is set once that gesture was detected; later ones are
+	// ignored while its action finishes.
+	onceDone bool
+)
+
+// exitAfterGesture shuts down once the actions started for the -once
+// gesture have finished.
+func exitAfterGesture() {
+	go func() {
+		commandsWG.Wait()
+		shutdown()
+	}()
+}
+
+// stopCommandTimeout bounds OnStopCommand so that it cannot hang shutdown.
+const stopCommandTimeout = 5 * time.Second
+
+// runStartCommand runs OnStartCommand in the background.
+func runStartCommand() {
+	command := liveConfig().OnStartCommand
+	if command == "" {
+		return
+	}
+	commandsWG.Add(1)
+	go func() {
+		defer commandsWG.Done()
+		if err := runCommand(command, 0, Action{}, Gesture{}); err != nil {
+			Log("error", fmt.Sprintf("Error executing start command: %v", err))
+		}
+	}()
+}
+
+// runStopCommand runs OnStopCommand and waits for it, for at most
+// stopCommandTimeout.
+func runStopCommand() {
+	command := liveConfig().OnStopCommand
+	if command == "" {
+		return
+	}
+	if err := runCommand(command, stopCommandTimeout, Action{}, Gesture{}); err != nil {
+		Log("error", fmt.Sprintf("Error executing stop command: %v", err))
+	}
+}
+
+// ------------------ Event Stream ------------------
+
+// streamRestartDelay is how long to wait before restarting a failed stream.
+const streamRestartDelay = time.Second
+
+// libinputCmd is the running "libinput debug-events" process.
+var libinputCmd atomic.Pointer[exec.Cmd]
+
+// streamEvents runs "libinput debug-events" and processes its output line by
+// line until the stream ends. It returns nil when libinput exits and the
+// read error when the stream broke (e.g. a line exceeded ScannerBufferSize),
+// in which case libinput has been stopped and can be restarted.
+func streamEvents() error {
+	// Start "libinput debug-events" as an external command.
+	cmd := exec.Command("libinput", "debug-events")
+	stdout, err := cmd.StdoutPipe()
+	if err != nil {
+		Log("error", fmt.Sprintf("Error creating stdout pipe: %v", err))
+		os.Exit(1)
+	}
+	stderr, err := cmd.StderrPipe()
+	if err != nil {
+		Log("error", fmt.Sprintf("Error creating stderr pipe: %v", err))
+		os.Exit(1)
+	}
+	if err := cmd.Start(); err != nil {
+		Log("error", fmt.Sprintf("Error starting libinput debug-events: %v", err))
+		os.Exit(1)
+	}
+	// The stderr pipe must be drained before cmd.Wait closes it.
+	stderrDone := make(chan struct{})
+	go func() {
+		defer close(stderrDone)
+		logLibinputStderr(stderr)
+	}()
+	libinputCmd.Store(cmd)
+	notifyReady()
+	// A new libinput process starts its clock from zero, and button
+	// releases made while the stream was down never arrive. evdev readers
+	// share eventClockBase, so it is only touched under eventMu.
+	eventMu.Lock()
+	clear(eventClockBase)
+	clear(heldButtons)
+	eventMu.Unlock()
+
+	// Process libinput output line by line.
+	scanner := bufio.NewScanner(stdout)
+	scanner.Buffer(make([]byte, 0, 64*1024), max(liveConfig().ScannerBufferSize, 64*1024))
+	for scanner.Scan() {
+		line := scanner.Text()
+		lineStartedAt.Store(time.Now().UnixNano())
+		if logEnabled("debug") {
+			Log("debug", fmt.Sprintf("Raw line: %s", line))
+		}
+		eventMu.Lock()
+		processLine(line)
+		eventMu.Unlock()
+		lineStartedAt.Store(0)
+	}
+	if err := scanner.Err(); err != nil {
+		cmd.Process.Kill()
+		<-stderrDone
+		cmd.Wait()
+		// The gestures in progress cannot be trusted after lost input.
+		eventMu.Lock()
+		forEachTouchDevice(func() {
+			if !evdevNodes[touchDevice] {
+				resetTouchState()
+			}
+		})
+		eventMu.Unlock()
+		return err
+	}
+	<-stderrDone
+	if err := cmd.Wait(); err != nil {
+		Log("warn", fmt.Sprintf("libinput debug-events terminated with error: %v", err))
+	}
+	return nil
+}
+
+// permissionErrors are lowercase fragments of libinput's stderr messages
+// for input devices it is not allowed to open.
+var permissionErrors = []string{"permission denied", "operation not permitted", "failed to open", "check that you have permission"}
+
+// logLibinputStderr logs the lines libinput debug-events writes to stderr.
+// The first permission error is explained with PermissionHint.
+func logLibinputStderr(r io.Reader) {
+	hinted := false
+	scanner := bufio.NewScanner(r)
+	for scanner.Scan() {
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" {
+			continue
+		}
+		Log("warn", fmt.Sprintf("libinput: %s", line))
+		lower := strings.ToLower(line)
+		if !hinted && slices.ContainsFunc(permissionErrors, func(s string) bool { return strings.Contains(lower, s) }) {
+			hinted = true
+			Log("error", fmt.Sprintf("libinput cannot read the input devices, so no gestures will be detected: %s", liveConfig().PermissionHint))
+		}
+	}
+}
+
+// notifyReady tells systemd we are up and starts the watchdog heartbeat
+// (no-ops when not running under systemd). Only the first call has an effect.
+func notifyReady() {
+	readyOnce.Do(func() {
+		sdNotify("READY=1")
+		startWatchdog()
+		runStartCommand()
+		if timeout := liveConfig().InitialEventTimeoutMs; timeout > 0 {
+			time.AfterFunc(time.Duration(timeout)*time.Millisecond, warnIfNoEvents)
+		}
+		go func() {
+			for range time.Tick(idleCheckInterval) {
+				eventMu.Lock()
+				checkIdle(time.Now())
+				eventMu.Unlock()
+			}
+		}()
+	})
+}
+
+// lastEventAt holds the UnixNano time of the most recent recognized libinput
+// event, or 0 if none has been seen yet.
+var lastEventAt atomic.Int64
+
+// markEvent records that a recognized event was just received.
+func markEvent() {
+	lastEventAt.Store(time.Now().UnixNano())
+}
+
+// warnIfNoEvents warns when no recognized event has arrived since startup,
+// which usually means libinput cannot read the input devices.
+func warnIfNoEvents() {
+	if lastEventAt.Load() != 0 {
+		return
+	}
+	Log("warn", fmt.Sprintf("No input events received from libinput within %dms. "+
+		"Check that your user can read /dev/input/event* (e.g. is in the input group) "+
+		"and that \"libinput debug-events\" shows your device.", liveConfig().InitialEventTimeoutMs))
+}
+
+// idleCheckInterval is how often checkIdle runs.
+const idleCheckInterval = time.Second
+
+var (
+	// lastGestureAt is when the last gesture was detected, or startup.
+	lastGestureAt = startedAt
+	// lastIdleReport is when IdleReportIntervalMs last logged a heartbeat.
+	lastIdleReport time.Time
+	// inputSilent is set while EventSilenceWarnMs has warned that no input
+	// events are arriving.
+	inputSilent bool
+)
+
+// checkIdle implements IdleReportIntervalMs and EventSilenceWarnMs. It must
+// be called with eventMu held.
+func checkIdle(now time.Time) {
+	last := lastEventAt.Load()
+	if last == 0 {
+		// Before the first event, warnIfNoEvents is responsible.
+		return
+	}
+	sinceEvent := now.Sub(time.Unix(0, last))
+	if ms := config.EventSilenceWarnMs; ms > 0 {
+		silence := time.Duration(ms) * time.Millisecond
+		if !inputSilent && sinceEvent >= silence {
+			Log("warn", fmt.Sprintf("No input events received for %s; the input device may have disappeared", sinceEvent.Round(time.Second)))
+			inputSilent = true
+		} else if inputSilent && sinceEvent < silence {
+			Log("info", "Input events are arriving again")
+			inputSilent = false
+		}
+	}
+	if ms := config.IdleReportIntervalMs; ms > 0 {
+		interval := time.Duration(ms) * time.Millisecond
+		since := lastGestureAt
+		if lastIdleReport.After(since) {
+			since = lastIdleReport
+		}
+		if sinceEvent < interval && now.Sub(since) >= interval {
+			Log("info", fmt.Sprintf("No gestures detected for %s, input events are still arriving", now.Sub(lastGestureAt).Round(time.Second)))
+			lastIdleReport = now
+		}
+	}
+}
+
+// ------------------ evdev Backend ------------------
+
+// Event types and codes from linux/input-event-codes.h used by the evdev
+// backend; FreeBSD's evdev uses the same values.
+const (
+	evSyn           = 0x00
+	evAbs           = 0x03
+	synReport       = 0x00
+	synDropped      = 0x03
+	absMTSlot       = 0x2f
+	absMTPositionX  = 0x35
+	absMTPositionY  = 0x36
+	absMTTrackingID = 0x39
+	inputPropDirect = 0x01
+)
+
+// evdevNodes holds the device nodes (e.g. "event11") read by the evdev
+// backend. libinput events from them are ignored.
+var evdevNodes = make(map[string]bool)
+
+// inputEvent mirrors the kernel's struct input_event.
+type inputEvent struct {
+	Time  syscall.Timeval
+	Type  uint16
+	Code  uint16
+	Value int32
+}
+
+// absInfo mirrors the kernel's struct input_absinfo.
+type absInfo struct {
+	Value, Minimum, Maximum, Fuzz, Flat, Resolution int32
+}
+
+// evdevSlot is the state of one multi-touch slot.
+type evdevSlot struct {
+	active bool
+	x, y   int32
+}
+
+// needsLibinput reports whether "libinput debug-events" has to run: for the
+// libinput backend, for devices configured to use it and for tablet tools,
+// keyboards and pointer buttons, which the evdev backend does not read.
+func needsLibinput() bool {
+	if config.Backend != "evdev" || config.EnableTablet || config.CancelOnKeyboard || config.DisableWhileTypingMs > 0 || config.SuppressWhileDragging {
+		return true
+	}
+	for name, device := range config.Devices {
+		if name != defaultDeviceBlock && device.Backend == "libinput" {
+			return true
+		}
+	}
+	return false
+}
+
+// evdevTargets returns the device nodes to read through evdev: devices
+// listed in Devices (by node or name) whose effective backend is "evdev"
+// and, with the global evdev backend, every unlisted touchscreen. Device
+// names are recorded in devices so that name-keyed blocks apply.
+func evdevTargets() []string {
+	wanted := config.Backend == "evdev"
+	for _, device := range config.Devices {
+		wanted = wanted || device.Backend == "evdev"
+	}
+	if !wanted {
+		return nil
+	}
+	var nodes []string
+	paths, _ := filepath.Glob("/dev/input/event*")
+	for _, path := range paths {
+		node, name := filepath.Base(path), evdevName(path)
+		device, configured := config.Devices[node]
+		if !configured && name != "" {
+			device, configured = config.Devices[name]
+		}
+		if ignoredNamedDevice(node, name) {
+			continue
+		}
+		if configured && cmp.Or(device.Backend, config.Backend) != "evdev" ||
+			!configured && (config.Backend != "evdev" || !isTouchscreen(path)) {
+			continue
+		}
+		if _, known := devices[node]; !known {
+			devices[node] = deviceInfo{name: name, capabilities: []string{"touch"}}
+		}
+		nodes = append(nodes, node)
+	}
+	return nodes
+}
+
+// startEvdevReaders starts a reader for every evdev target and returns how
+// many were started.
+func startEvdevReaders() int {
+	nodes := evdevTargets()
+	for _, node := range nodes {
+		evdevNodes[node] = true
+		go readEvdev(node)
+	}
+	return len(nodes)
+}
+
+// readEvdev streams events from node, reopening it after errors such as the
+// device being unplugged.
+func readEvdev(node string) {
+	for {
+		err := streamEvdev(node)
+		Log("warn", fmt.Sprintf("Error reading %s: %v; reopening in %s", node, err, streamRestartDelay))
+		time.Sleep(streamRestartDelay)
+	}
+}
+
+// streamEvdev reads multi-touch (protocol B) events from node and feeds
+// each SYN_REPORT to the touch tracker as a frame, with coordinates scaled
+// to 0-100 like libinput's. It only returns on error.
+func streamEvdev(node string) error {
+	f, err := os.Open(filepath.Join("/dev/input", node))
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	xAxis, err := evdevAxis(f, absMTPositionX)
+	if err != nil {
+		return fmt.Errorf("no multi-touch X axis: %w", err)
+	}
+	yAxis, err := evdevAxis(f, absMTPositionY)
+	if err != nil {
+		return fmt.Errorf("no multi-touch Y axis: %w", err)
+	}
+	Log("info", fmt.Sprintf("Reading %s through evdev", node))
+
+	slots := make(map[int]*evdevSlot)
+	slot := func(n int) *evdevSlot {
+		if slots[n] == nil {
+			slots[n] = &evdevSlot{}
+		}
+		return slots[n]
+	}
+	current, dropping := 0, false
+	reader := bufio.NewReader(f)
+	for {
+		var ev inputEvent
+		if err := binary.Read(reader, binary.NativeEndian, &ev); err != nil {
+			eventMu.Lock()
+			switchTouchDevice(node)
+			resetTouchState()
+			eventMu.Unlock()
+			return err
+		}
+		// After SYN_DROPPED everything up to the next SYN_REPORT is
+		// unreliable, and so is the gesture in progress.
+		if dropping {
+			if ev.Type == evSyn && ev.Code == synReport {
+				dropping = false
+				eventMu.Lock()
+				switchTouchDevice(node)
+				cancelGesture("evdev events dropped")
+				eventMu.Unlock()
+			}
+			continue
+		}
+		switch {
+		case ev.Type == evAbs && ev.Code == absMTSlot:
+			current = int(ev.Value)
+		case ev.Type == evAbs && ev.Code == absMTTrackingID:
+			slot(current).active = ev.Value >= 0
+		case ev.Type == evAbs && ev.Code == absMTPositionX:
+			slot(current).x = ev.Value
+		case ev.Type == evAbs && ev.Code == absMTPositionY:
+			slot(current).y = ev.Value
+		case ev.Type == evSyn && ev.Code == synDropped:
+			dropping = true
+		case ev.Type == evSyn && ev.Code == synReport:
+			eventTime := float64(ev.Time.Sec) + float64(ev.Time.Usec)/1e6
+			evdevFrame(node, slots, xAxis, yAxis, eventTime)
+		}
+	}
+}
+
+// evdevFrame reports every active slot of node as a touch and completes the
+// frame.
+func evdevFrame(node string, slots map[int]*evdevSlot, xAxis, yAxis absInfo, eventTime float64) {
+	eventMu.Lock()
+	defer eventMu.Unlock()
+	if time.Since(lastSweep) >= sweepInterval {
+		sweepStaleTouches()
+	}
+	markEvent()
+	switchTouchDevice(node)
+	noteEventTime(node, eventTime)
+	for id, s := range slots {
+		if s.active {
+			x, y := rotatePoint(scaleAxis(s.x, xAxis), scaleAxis(s.y, yAxis), currentRotation())
+			updateTouch(id, x, y, eventTime)
+		}
+	}
+	processFrame(eventTime)
+}
+
+// scaleAxis maps a raw axis value to 0-100.
+func scaleAxis(value int32, axis absInfo) float64 {
+	if axis.Maximum <= axis.Minimum {
+		return 0
+	}
+	return 100 * float64(value-axis.Minimum) / float64(axis.Maximum-axis.Minimum)
+}
+
+// isTouchscreen reports whether the device at path is a direct multi-touch
+// device (a touchscreen rather than a touchpad).
+func isTouchscreen(path string) bool {
+	f, err := os.Open(path)
+	if err != nil {
+		return false
+	}
+	defer f.Close()
+	var props [8]byte
+	if err := ioctl(f.Fd(), evdevIoctlRead(0x09, uintptr(len(props))), unsafe.Pointer(&props)); err != nil {
+		return false
+	}
+	if props[0]&(1<<inputPropDirect) == 0 {
+		return false
+	}
+	_, err = evdevAxis(f, absMTSlot)
+	return err == nil
+}
+
+// evdevName returns the name of the device at path (EVIOCGNAME), or "".
+func evdevName(path string) string {
+	f, err := os.Open(path)
+	if err != nil {
+		return ""
+	}
+	defer f.Close()
+	var name [256]byte
+	if err := ioctl(f.Fd(), evdevIoctlRead(0x06, uintptr(len(name))), unsafe.Pointer(&name)); err != nil {
+		return ""
+	}
+	return string(bytes.TrimRight(name[:], "\x00"))
+}
+
+// evdevAxis queries the range of an absolute axis (EVIOCGABS).
+func evdevAxis(f *os.File, code uintptr) (absInfo, error) {
+	var info absInfo
+	err := ioctl(f.Fd(), evdevIoctlRead(0x40+code, unsafe.Sizeof(info)), unsafe.Pointer(&info))
+	return info, err
+}
+
+// evdevIoctlRead returns the request number of a read ioctl in the evdev
+// ('E') group. Linux and the BSDs encode the direction differently.
+func evdevIoctlRead(nr, size uintptr) uintptr {
+	dir := uintptr(2) // Linux _IOC_READ
+	if runtime.GOOS != "linux" {
+		dir = 1 // BSD IOC_OUT
+	}
+	return dir<<30 | size<<16 | 'E'<<8 | nr
+}
+
+// ioctl performs an ioctl system call on fd.
+func ioctl(fd, req uintptr, arg unsafe.Pointer) error {
+	if _, _, errno := syscall.Syscall(syscall.SYS_IOCTL, fd, req, uintptr(arg)); errno != 0 {
+		return errno
+	}
+	return nil
+}
+
+// ------------------ systemd Integration ------------------
+
+// readyOnce ensures READY=1 is only sent for the first libinput stream.
+var readyOnce sync.Once
+
+// lineStartedAt holds the UnixNano time at which the event loop started
+// processing the current line, or 0 while it is waiting for input.
+var lineStartedAt atomic.Int64
+
+// sdNotify sends a state message (e.g. "READY=1") to systemd. It is a no-op
+// when NOTIFY_SOCKET is not set.
+func sdNotify(state string) {
+	socket := os.Getenv("NOTIFY_SOCKET")
+	if socket == "" {
+		return
+	}
+	// A leading '@' denotes a socket in the abstract namespace.
+	if strings.HasPrefix(socket, "@") {
+		socket = "\x00" + socket[1:]
+	}
+	conn, err := net.DialUnix("unixgram", nil, &net.UnixAddr{Name: socket, Net: "unixgram"})
+	if err != nil {
+		Log("debug", fmt.Sprintf("Error connecting to systemd notify socket: %v", err))
+		return
+	}
+	defer conn.Close()
+	if _, err := conn.Write([]byte(state)); err != nil {
+		Log("debug", fmt.Sprintf("Error sending %q to systemd: %v", state, err))
+	}
+}
+
+// startWatchdog pings the systemd watchdog at half the interval given by
+// WATCHDOG_USEC. A ping is withheld while the event loop has been stuck on a
+// single line for longer than the interval, so systemd restarts a wedged
+// daemon. It is a no-op when the watchdog is not enabled.
+func startWatchdog() {
+	usec, err := strconv.ParseInt(os.Getenv("WATCHDOG_USEC"), 10, 64)
+	if err != nil || usec <= 0 {
+		return
+	}
+	if pid := os.Getenv("WATCHDOG_PID"); pid != "" && pid != strconv.Itoa(os.Getpid()) {
+		return
+	}
+	interval := time.Duration(usec) * time.Microsecond / 2
+	Log("debug", fmt.Sprintf("systemd watchdog enabled, pinging every %s", interval))
+	go func() {
+		for range time.Tick(interval) {
+			if started := lineStartedAt.Load(); started != 0 && time.Since(time.Unix(0, started)) > interval {
+				Log("warn", "Event loop appears stuck, withholding watchdog ping")
+				continue
+			}
+			sdNotify("WATCHDOG=1")
+		}
+	}()
+}
+
+// ------------------ Control API ------------------
+
+var (
+	// eventMu serializes event processing with requests from the control API
+	// and SIGHUP, which read and replace state owned by the event loop.
+	eventMu sync.Mutex
+	// executionDisabled suppresses gesture actions while set.
+	executionDisabled atomic.Bool
+	// gesturesDetected and gesturesExecuted count gestures since startup.
+	gesturesDetected atomic.Int64
+	gesturesExecuted atomic.Int64
+	// startedAt is when the process started.
+	startedAt = time.Now()
+)
+
+// controlStats is the JSON body returned by the control API's /stats.
+type controlStats struct {
+	Enabled          bool    `json:"enabled"`
+	UptimeSeconds    float64 `json:"uptimeSeconds"`
+	GesturesDetected int64   `json:"gesturesDetected"`
+	GesturesExecuted int64   `json:"gesturesExecuted"`
+	ActiveLayer      string  `json:"activeLayer"`
+	ActiveMode       string  `json:"activeMode"`
+	LibinputVersion  string  `json:"libinputVersion"`
+}
+
+// startControlServer serves the HTTP control API on ControlAddr:
+//
+//	POST /enable, POST /disable  turn gesture execution on or off
+//	POST /reload                 reload the configuration file
+//	GET  /config                 the effective configuration
+//	GET  /stats                  counters and runtime state
+//
+// An address without a host (e.g. ":7117") binds to localhost.
+func startControlServer() {
+	addr := config.ControlAddr
+	if host, port, err := net.SplitHostPort(addr); err == nil && host == "" {
+		addr = net.JoinHostPort("127.0.0.1", port)
+	}
+	listener, err := net.Listen("tcp", addr)
+	if err != nil {
+		Log("error", fmt.Sprintf("Could not start control API on %s: %v", addr, err))
+		return
+	}
+	mux := http.NewServeMux()
+	mux.HandleFunc("POST /enable", func(w http.ResponseWriter, r *http.Request) {
+		setExecutionEnabled(true)
+		writeJSON(w, http.StatusOK, map[string]bool{"enabled": true})
+	})
+	mux.HandleFunc("POST /disable", func(w http.ResponseWriter, r *http.Request) {
+		setExecutionEnabled(false)
+		writeJSON(w, http.StatusOK, map[string]bool{"enabled": false})
+	})
+	mux.HandleFunc("POST /reload", func(w http.ResponseWriter, r *http.Request) {
+		ok := reload()
+		status := http.StatusOK
+		if !ok {
+			status = http.StatusInternalServerError
+		}
+		writeJSON(w, status, map[string]bool{"reloaded": ok})
+	})
+	mux.HandleFunc("GET /config", func(w http.ResponseWriter, r *http.Request) {
+		eventMu.Lock()
+		effective := effectiveConfig{configSources, libinputVersion, keyInjectionStatus(), config}
+		eventMu.Unlock()
+		writeJSON(w, http.StatusOK, effective)
+	})
+	mux.HandleFunc("GET /stats", func(w http.ResponseWriter, r *http.Request) {
+		eventMu.Lock()
+		stats := controlStats{
+			Enabled:          !executionDisabled.Load(),
+			UptimeSeconds:    time.Since(startedAt).Seconds(),
+			GesturesDetected: gesturesDetected.Load(),
+			GesturesExecuted: gesturesExecuted.Load(),
+			ActiveLayer:      activeLayer,
+			ActiveMode:       activeMode,
+			LibinputVersion:  libinputVersion,
+		}
+		eventMu.Unlock()
+		writeJSON(w, http.StatusOK, stats)
+	})
+	Log("info", fmt.Sprintf("Control API listening on %s", listener.Addr()))
+	go func() {
+		if err := http.Serve(listener, mux); err != nil {
+			Log("error", fmt.Sprintf("Control API stopped: %v", err))
+		}
+	}()
+}
+
+// setExecutionEnabled turns gesture execution on or off.
+func setExecutionEnabled(enabled bool) {
+	executionDisabled.Store(!enabled)
+	if enabled {
+		Log("info", "Gesture execution enabled")
+	} else {
+		Log("info", "Gesture execution disabled")
+	}
+}
+
+// writeJSON writes v as the JSON response body with the given status.
+func writeJSON(w http.ResponseWriter, status int, v any) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	if err := json.NewEncoder(w).Encode(v); err != nil {
+		Log("error", fmt.Sprintf("Error writing control API response: %v", err))
+	}
+}
+
+// ------------------ libinput Version ------------------
+
+// libinputVersion is the version reported by "libinput --version", or "" if
+// it could not be determined.
+var libinputVersion string
+
+// libinputVersionRegex extracts a dotted version number.
+var libinputVersionRegex = regexp.MustCompile(`\d+(?:\.\d+)+`)
+
+// detectLibinputVersion runs "libinput --version" and records the version.
+func detectLibinputVersion() {
+	output, err := exec.Command("libinput", "--version").Output()
+	if err != nil {
+		Log("warn", fmt.Sprintf("Could not determine libinput version: %v", err))
+		return
+	}
+	libinputVersion = libinputVersionRegex.FindString(string(output))
+	if libinputVersion == "" {
+		Log("warn", fmt.Sprintf("Could not parse libinput version from %q", strings.TrimSpace(string(output))))
+		return
+	}
+	Log("info", fmt.Sprintf("libinput version %s", libinputVersion))
+}
+
+// compareVersions compares dotted version numbers numerically, returning -1,
+// 0 or 1. Missing components count as 0.
+func compareVersions(a, b string) int {
+	as, bs := strings.Split(a, "."), strings.Split(b, ".")
+	for i := 0; i < max(len(as), len(bs)); i++ {
+		var x, y int
+		if i < len(as) {
+			x, _ = strconv.Atoi(as[i])
+		}
+		if i < len(bs) {
+			y, _ = strconv.Atoi(bs[i])
+		}
+		if c := cmp.Compare(x, y); c != 0 {
+			return c
+		}
+	}
+	return 0
+}
+
+// ------------------ Devices ------------------
+
+// deviceInfo describes an input device reported by "libinput list-devices".
+type deviceInfo struct {
+	name         string
+	capabilities []string
+}
+
+// devices maps device nodes as they appear in debug-events output (e.g.
+// "event5") to their description. It is empty when detection is disabled or
+// failed, in which case every device is treated as a touchscreen.
+var devices = make(map[string]deviceInfo)
+
+// detectDevices queries "libinput list-devices" and records each device's
+// capabilities so that touchscreens and touchpads can be handled natively.
+func detectDevices() {
+	output, err := exec.Command("libinput", "list-devices").Output()
+	if err != nil {
+		Log("warn", fmt.Sprintf("Could not list input devices, treating all devices as touchscreens: %v", err))
+		return
+	}
+	devices = parseDeviceList(string(output))
+	for _, node := range slices.Sorted(maps.Keys(devices)) {
+		info := devices[node]
+		Log("info", fmt.Sprintf("Device %s (%s): capabilities %s, using %s events", node, info.name, strings.Join(info.capabilities, " "), deviceMode(node)))
+	}
+}
+
+// parseDeviceList parses the output of "libinput list-devices".
+func parseDeviceList(output string) map[string]deviceInfo {
+	result := make(map[string]deviceInfo)
+	var name, node string
+	for _, line := range strings.Split(output, "\n") {
+		key, value, ok := strings.Cut(line, ":")
+		if !ok {
+			continue
+		}
+		value = strings.TrimSpace(value)
+		switch strings.TrimSpace(key) {
+		case "Device":
+			name, node = value, ""
+		case "Kernel":
+			node = filepath.Base(value)
+		case "Capabilities":
+			if node != "" {
+				result[node] = deviceInfo{name: name, capabilities: strings.Fields(value)}
+			}
+		}
+	}
+	return result
+}
+
+// ignoredDevice reports whether node is listed in IgnoredDevices.
+func ignoredDevice(node string) bool {
+	return ignoredNamedDevice(node, devices[node].name)
+}
+
+// ignoredNamedDevice reports whether the device node with the given name
+// ("" if unknown) is listed in IgnoredDevices, by node or by a substring of
+// its name.
+func ignoredNamedDevice(node, name string) bool {
+	return slices.ContainsFunc(config.IgnoredDevices, func(entry string) bool {
+		return entry == node || name != "" && strings.Contains(name, entry)
+	})
+}
+
+// deviceMode returns how events from the device node are processed: "touch"
+// for touchscreens (TOUCH_* events and the frame heuristic), "gesture" for
+// touchpads (libinput's GESTURE_SWIPE events) or "" for devices that produce
+// neither. Unknown devices are treated as touchscreens.
+func deviceMode(node string) string {
+	info, ok := devices[node]
+	switch {
+	case !ok || slices.Contains(info.capabilities, "touch"):
+		return "touch"
+	case slices.Contains(info.capabilities, "gesture"):
+		return "gesture"
+	default:
+		return ""
+	}
+}
+
+// touchpadSwipe accumulates a GESTURE_SWIPE sequence from a touchpad.
+type touchpadSwipe struct {
+	fingers   int
+	dx, dy    float64
+	startTime float64
+}
+
+// touchpadSwipes holds the swipe in progress per device node.
+var touchpadSwipes = make(map[string]*touchpadSwipe)
+
+// processGestureSwipe handles a GESTURE_SWIPE event matched by
+// gestureSwipeRegex, classifying the swipe when it ends.
+func processGestureSwipe(matches []string) {
+	node, phase := matches[1], matches[2]
+	eventTime, _ := strconv.ParseFloat(matches[3], 64)
+	fingers, _ := strconv.Atoi(matches[4])
+	noteEventTime(node, eventTime)
+	switch phase {
+	case "BEGIN":
+		touchpadSwipes[node] = &touchpadSwipe{fingers: fingers, startTime: eventTime}
+	case "UPDATE":
+		swipe, ok := touchpadSwipes[node]
+		if !ok {
+			return
+		}
+		dx, _ := strconv.ParseFloat(matches[5], 64)
+		dy, _ := strconv.ParseFloat(matches[6], 64)
+		swipe.dx += dx
+		swipe.dy += dy
+	case "END":
+		swipe, ok := touchpadSwipes[node]
+		delete(touchpadSwipes, node)
+		if !ok {
+			return
+		}
+		if matches[7] != "" {
+			Log("debug", fmt.Sprintf("Touchpad swipe on %s cancelled", node))
+			return
+		}
+		if !fingerCountAllowed(swipe.fingers) || dragging() {
+			return
+		}
+		Log("info", fmt.Sprintf("Touchpad gesture completed with %d finger(s): dx=%s, dy=%s", swipe.fingers, formatFloat(swipe.dx), formatFloat(swipe.dy)))
+		duration := eventTime - swipe.startTime
+		if config.LearningMode {
+			recordSample(swipe.fingers, math.Hypot(swipe.dx, swipe.dy), duration)
+		}
+		direction := classifySwipe(swipe.fingers, swipe.dx, swipe.dy, duration)
+		if direction == "" {
+			return
+		}
+		g := Gesture{
+			Type:      "swipe",
+			Count:     swipe.fingers,
+			Direction: direction,
+			Dx:        swipe.dx,
+			Dy:        swipe.dy,
+		}
+		g.Key = gestureKey(g)
+		Log("info", fmt.Sprintf("Detected gesture: %s", g.Key))
+		if config.SnapToNearest {
+			g = snapToNearest(g)
+		}
+		dispatchGesture(g)
+	}
+}
+
+// ------------------ Tablet Tools ------------------
+
+// penStroke accumulates a tablet tool stroke from tip down to tip up.
+type penStroke struct {
+	startX, startY float64
+	lastX, lastY   float64
+	startTime      float64
+	maxPressure    float64
+}
+
+// penStrokes holds the stroke in progress per device node.
+var penStrokes = make(map[string]*penStroke)
+
+// processTabletTool handles a tablet tool event matched by tabletToolRegex,
+// classifying the stroke when the tip lifts.
+func processTabletTool(matches []string) {
+	node, tip := matches[1], matches[7]
+	eventTime, _ := strconv.ParseFloat(matches[3], 64)
+	x, _ := strconv.ParseFloat(matches[4], 64)
+	y, _ := strconv.ParseFloat(matches[5], 64)
+	pressure, _ := strconv.ParseFloat(matches[6], 64)
+
+	if tip == "down" {
+		penStrokes[node] = &penStroke{startX: x, startY: y, lastX: x, lastY: y, startTime: eventTime, maxPressure: pressure}
+		return
+	}
+	stroke, ok := penStrokes[node]
+	if !ok {
+		return
+	}
+	stroke.lastX, stroke.lastY = x, y
+	stroke.maxPressure = max(stroke.maxPressure, pressure)
+	if tip != "up" {
+		return
+	}
+	delete(penStrokes, node)
+
+	dx, dy := stroke.lastX-stroke.startX, stroke.lastY-stroke.startY
+	Log("info", fmt.Sprintf("Pen stroke completed: dx=%s, dy=%s, pressure=%s", formatFloat(dx), formatFloat(dy), formatFloat(stroke.maxPressure)))
+	if config.MaxGestureDurationMs > 0 && eventTime-stroke.startTime > float64(config.MaxGestureDurationMs)/1000 {
+		Log("debug", "Pen stroke took longer than maxGestureDurationMs, ignored")
+		return
+	}
+	if math.Abs(dx) < config.TabletThreshold && math.Abs(dy) < config.TabletThreshold {
+		Log("debug", "Pen movement below tabletThreshold, stroke ignored")
+		return
+	}
+	direction := swipeDirection(dx, dy)
+	if slices.Contains(config.DisabledDirections, direction) {
+		Log("debug", fmt.Sprintf("Direction %s is disabled, stroke ignored", direction))
+		return
+	}
+	g := Gesture{
+		Type:      "pen",
+		Count:     1,
+		Direction: direction,
+		Dx:        dx,
+		Dy:        dy,
+		StartX:    stroke.startX,
+		StartY:    stroke.startY,
+		EndX:      stroke.lastX,
+		EndY:      stroke.lastY,
+		Pressure:  stroke.maxPressure,
+	}
+	g.Key = fmt.Sprintf("%s_p%d", gestureKey(g), pressureLevel(stroke.maxPressure))
+	Log("info", fmt.Sprintf("Detected gesture: %s", g.Key))
+	dispatchGesture(g)
+}
+
+// pressureLevel returns the number of TabletPressureLevels thresholds that
+// pressure reaches.
+func pressureLevel(pressure float64) int {
+	level := 0
+	for _, threshold := range config.TabletPressureLevels {
+		if pressure >= threshold {
+			level++
+		}
+	}
+	return level
+}
+
+// ------------------ Coordinate Transforms ------------------
+
+// rotatePoint maps panel coordinates (0-100 on each axis, as reported by
+// libinput) to logical coordinates for a panel rotated clockwise by rotation
+// degrees.
+func rotatePoint(x, y float64, rotation int) (float64, float64) {
+	switch rotation {
+	case 90:
+		return y, 100 - x
+	case 180:
+		return 100 - x, 100 - y
+	case 270:
+		return 100 - y, x
+	default:
+		return x, y
+	}
+}
+
+// detectedRotation holds the rotation reported by RotationCommand, or -1 when
+// detection is disabled or failed.
+var detectedRotation atomic.Int32
+
+func init() {
+	detectedRotation.Store(-1)
+}
+
+// currentRotation returns the detected display rotation, falling back to the
+// static ScreenRotation.
+func currentRotation() int {
+	if r := detectedRotation.Load(); r >= 0 {
+		return int(r)
+	}
+	return config.ScreenRotation
+}
+
+// startRotationDetection polls RotationCommand in the background and caches
+// the reported rotation.
+func startRotationDetection() {
+	interval := time.Duration(config.RotationRefreshMs) * time.Millisecond
+	if interval <= 0 {
+		interval = 5 * time.Second
+	}
+	refreshRotation()
+	go func() {
+		for range time.Tick(interval) {
+			refreshRotation()
+		}
+	}()
+}
+
+// refreshRotation runs RotationCommand and updates detectedRotation.
+func refreshRotation() {
+	output, err := exec.Command("sh", "-c", liveConfig().RotationCommand).Output()
+	if err != nil {
+		Log("debug", fmt.Sprintf("Rotation command failed, using screenRotation: %v", err))
+		detectedRotation.Store(-1)
+		return
+	}
+	rotation, ok := parseRotation(string(output))
+	if !ok {
+		Log("debug", fmt.Sprintf("Could not parse rotation from %q, using screenRotation", strings.TrimSpace(string(output))))
+		detectedRotation.Store(-1)
+		return
+	}
+	if previous := detectedRotation.Swap(int32(rotation)); previous != int32(rotation) {
+		Log("info", fmt.Sprintf("Display rotation is now %d", rotation))
+	}
+}
+
+// parseRotation extracts a clockwise rotation from the first recognized word
+// in output. It understands degrees (as printed by wlr-randr) and xrandr's
+// normal/right/inverted/left.
+func parseRotation(output string) (int, bool) {
+	for _, word := range strings.Fields(strings.ToLower(output)) {
+		switch word {
+		case "0", "normal":
+			return 0, true
+		case "90", "right":
+			return 90, true
+		case "180", "inverted":
+			return 180, true
+		case "270", "left":
+			return 270, true
+		}
+	}
+	return 0, false
+}
+
+// ------------------ Event Handlers ------------------
+
+var (
+	// eventClockBase maps each device node to the wall-clock time, in
+	// seconds since the epoch, at which its event timestamps are zero. It is
+	// estimated from the event that arrived soonest after its timestamp.
+	eventClockBase = make(map[string]float64)
+	// lastInputAt is the estimated wall-clock time of the latest input event.
+	lastInputAt time.Time
+)
+
+// noteEventTime records the timestamp of an input event from node for
+// LogLatency.
+func noteEventTime(node string, eventTime float64) {
+	if !config.LogLatency {
+		return
+	}
+	base := float64(time.Now().UnixNano())/1e9 - eventTime
+	if current, ok := eventClockBase[node]; ok && current < base {
+		base = current
+	}
+	eventClockBase[node] = base
+	lastInputAt = time.Unix(0, int64((base+eventTime)*1e9))
+}
+
+// processLine handles a single line from libinput.
+// We only process TOUCH_MOTION events; TOUCH_FRAME events are handled separately.
+func processLine(line string) {
+	if time.Since(lastSweep) >= sweepInterval {
+		sweepStaleTouches()
+	}
+
+	if len(config.IgnoredDevices) > 0 {
+		if fields := strings.Fields(line); len(fields) > 0 && ignoredDevice(strings.TrimPrefix(fields[0], "-")) {
+			return
+		}
+	}
+
+	// Check if this is a TOUCH_FRAME event.
+	if matches := touchFrameRegex.FindStringSubmatch(line); matches != nil {
+		markEvent()
+		if deviceMode(matches[1]) != "touch" || evdevNodes[matches[1]] {
+			return
+		}
+		recordRawLine(line)
+		Log("debug", "Detected TOUCH_FRAME event")
+		frameTime, _ := strconv.ParseFloat(matches[2], 64)
+		switchTouchDevice(matches[1])
+		processFrame(frameTime)
+		return
+	}
+
+	if keyboardKeyRegex.MatchString(line) {
+		markEvent()
+		lastKeyPress = time.Now()
+		if config.CancelOnKeyboard {
+			forEachTouchDevice(func() { cancelGesture("keyboard key pressed") })
+		}
+		return
+	}
+
+	if matches := pointerButtonRegex.FindStringSubmatch(line); matches != nil {
+		markEvent()
+		button := matches[1] + " " + matches[2]
+		if matches[3] == "released" {
+			delete(heldButtons, button)
+			return
+		}
+		heldButtons[button] = true
+		if config.SuppressWhileDragging {
+			forEachTouchDevice(func() { cancelGesture("pointer button pressed") })
+		}
+		return
+	}
+
+	if matches := tabletToolRegex.FindStringSubmatch(line); matches != nil {
+		markEvent()
+		if config.EnableTablet {
+			currentDevice = matches[1]
+			processTabletTool(matches)
+		}
+		return
+	}
+
+	if matches := gestureSwipeRegex.FindStringSubmatch(line); matches != nil {
+		markEvent()
+		if deviceMode(matches[1]) == "gesture" && !evdevNodes[matches[1]] {
+			currentDevice = matches[1]
+			recordRawLine(line)
+			processGestureSwipe(matches)
+		}
+		return
+	}
+
+	// Attempt to match a TOUCH_MOTION event.
+	var matches []string
+	for _, regex := range touchEventRegexes {
+		if matches = regex.FindStringSubmatch(line); matches != nil {
+			break
+		}
+	}
+	if len(matches) == 0 {
+		Log("debug", fmt.Sprintf("Line did not match any known pattern: %s", line))
+		return
+	}
+	markEvent()
+	if deviceMode(matches[1]) != "touch" || evdevNodes[matches[1]] {
+		return
+	}
+	switchTouchDevice(matches[1])
+	recordRawLine(line)
+
+	fingerID, err := strconv.Atoi(matches[4])
+	if err != nil {
+		Log("error", fmt.Sprintf("Error parsing finger ID: %v", err))
+		return
+	}
+
+	// Parse the event time (seconds since libinput started).
+	eventTime, err := strconv.ParseFloat(matches[3], 64)
+	if err != nil {
+		Log("error", fmt.Sprintf("Error parsing event time: %v", err))
+	} else {
+		noteEventTime(currentDevice, eventTime)
+	}
+
+	// Lines without coordinates keep the finger alive at its previous
+	// position instead of moving it to (0, 0).
+	if matches[5] == "" || matches[6] == "" {
+		touchSeen(fingerID, eventTime)
+		return
+	}
+	x, err := strconv.ParseFloat(matches[5], 64)
+	if err != nil {
+		Log("error", fmt.Sprintf("Error parsing x coordinate: %v", err))
+		touchSeen(fingerID, eventTime)
+		return
+	}
+	y, err := strconv.ParseFloat(matches[6], 64)
+	if err != nil {
+		Log("error", fmt.Sprintf("Error parsing y coordinate: %v", err))
+		touchSeen(fingerID, eventTime)
+		return
+	}
+	x, y = rotatePoint(x, y, currentRotation())
+
+	updateTouch(fingerID, x, y, eventTime)
+}
+
+// touchSeen records an event for fingerID that carries no coordinates. The
+// finger counts as updated in the current frame and keeps its position; a
+// finger not yet tracked is only started once its position is known.
+func touchSeen(fingerID int, eventTime float64) {
+	currentFrameUpdated[fingerID] = true
+	if tp, exists := activeTouches[fingerID]; exists {
+		tp.lastTime = eventTime
+		tp.lastSeen = time.Now()
+		Log("debug", fmt.Sprintf("TOUCH_MOTION: finger %d without coordinates, keeping (%s, %s)", fingerID, formatFloat(tp.lastX), formatFloat(tp.lastY)))
+	}
+}
+
+// updateTouch records a motion of fingerID to (x, y) at the given libinput
+// event time.
+func updateTouch(fingerID int, x, y, eventTime float64) {
+	// Mark that this finger updated during the current frame.
+	currentFrameUpdated[fingerID] = true
+
+	// Fingers left behind by an already completed gesture are ignored until
+	// they lift.
+	if stragglers[fingerID] {
+		return
+	}
+
+	if completionTimer != nil {
+		stopCompletion()
+		if tp, finished := finishedTouchesMap[fingerID]; finished {
+			delete(finishedTouchesMap, fingerID)
+			activeTouches[fingerID] = tp
+			Log("debug", fmt.Sprintf("Finger %d returned within completeDelayMs, resuming the gesture", fingerID))
+		} else {
+			Log("debug", fmt.Sprintf("Finger %d added within completeDelayMs, continuing the gesture", fingerID))
+		}
+	}
+
+	// Process the TOUCH_MOTION event.
+	// If the finger is not already active, create a new record using the current coordinates.
+	if tp, exists := activeTouches[fingerID]; exists {
+		tp.pathLength += math.Hypot(x-tp.lastX, y-tp.lastY)
+		tp.lastX = x
+		tp.lastY = y
+		tp.lastTime = eventTime
+		tp.lastSeen = time.Now()
+		tp.samples++
+		if config.PathCornerAngle > 0 {
+			recordPathPoint(tp)
+		}
+		Log("debug", fmt.Sprintf("TOUCH_MOTION: finger %d moved to (%s, %s)", fingerID, formatFloat(x), formatFloat(y)))
+	} else {
+		if config.MaxFingers > 0 && len(activeTouches) >= config.MaxFingers {
+			// Too many fingers for any gesture: stop tracking more of them
+			// and discard the interaction.
+			cancelGesture(fmt.Sprintf("more than %d fingers", config.MaxFingers))
+			return
+		}
+		tp := &TouchPoint{
+			id:        fingerID,
+			startX:    x,
+			startY:    y,
+			lastX:     x,
+			lastY:     y,
+			startTime: eventTime,
+			lastTime:  eventTime,
+			lastSeen:  time.Now(),
+			samples:   1,
+		}
+		if config.DetectRestingTap {
+			detectRestingTap()
+		}
+		if config.ChordHoldMinMs > 0 {
+			armChord(eventTime)
+		}
+		if config.PathCornerAngle > 0 {
+			recordPathPoint(tp)
+		}
+		activeTouches[fingerID] = tp
+		Log("debug", fmt.Sprintf("TOUCH_MOTION (new): finger %d at (%s, %s)", fingerID, formatFloat(x), formatFloat(y)))
+	}
+}
+
+// sweepInterval is how often the touch maps are checked for stale entries.
+const sweepInterval = time.Second
+
+// lastSweep is when sweepStaleTouches last ran.
+var lastSweep time.Time
+
+// sweepStaleTouches bounds the memory used for touch tracking on devices that
+// never emit proper TOUCH_FRAMEs. Touches not seen for TouchStaleMs are
+// reaped, and a device's tracking is reset if more than MaxTrackedTouches
+// entries accumulate.
+func sweepStaleTouches() {
+	lastSweep = time.Now()
+	forEachTouchDevice(sweepDeviceTouches)
+}
+
+// sweepDeviceTouches sweeps the touches of the current device.
+func sweepDeviceTouches() {
+	if config.TouchStaleMs > 0 {
+		staleness := time.Duration(config.TouchStaleMs) * time.Millisecond
+		for _, touches := range []map[int]*TouchPoint{activeTouches, finishedTouchesMap} {
+			for fingerID, tp := range touches {
+				if time.Since(tp.lastSeen) > staleness {
+					delete(touches, fingerID)
+					Log("warn", fmt.Sprintf("Reaped stale touch for finger %d (last seen %s ago)", fingerID, time.Since(tp.lastSeen).Round(time.Millisecond)))
+				}
+			}
+		}
+		if len(activeTouches) == 0 && len(finishedTouchesMap) == 0 {
+			clear(stragglers)
+			gestureCancelled = false
+		}
+	}
+	if tracked := len(activeTouches) + len(finishedTouchesMap) + len(stragglers); config.MaxTrackedTouches > 0 && tracked > config.MaxTrackedTouches {
+		Log("warn", fmt.Sprintf("Tracking %d touches, more than maxTrackedTouches (%d); resetting touch state", tracked, config.MaxTrackedTouches))
+		resetTouchState()
+	}
+}
+
+// resetAllTouchState resets the touch state of every device and forgets the
+// devices.
+func resetAllTouchState() {
+	forEachTouchDevice(resetTouchState)
+	clear(savedTouchStates)
+}
+
+// resetTouchState forgets all tracked touches of the current device without
+// dispatching a gesture.
+func resetTouchState() {
+	stopCompletion()
+	rawLines = nil
+	chordHeld = nil
+	clear(activeTouches)
+	clear(finishedTouchesMap)
+	clear(stragglers)
+	clear(currentFrameUpdated)
+	gestureCancelled = false
+	centroidFingers = 0
+	liveDirection = ""
+	if holdFingers > 0 {
+		endHold()
+	}
+}
+
+// chordHeld holds the fingers held down for a chord, or nil when no chord is
+// armed.
+var chordHeld map[int]bool
+
+// armChord is called when a finger lands at eventTime. If every active
+// finger has stayed within HoldMaxTravel for ChordHoldMinMs, they become the
+// held fingers of a chord.
+func armChord(eventTime float64) {
+	if chordHeld != nil || len(activeTouches) == 0 {
+		return
+	}
+	for _, tp := range activeTouches {
+		if eventTime-tp.startTime < float64(config.ChordHoldMinMs)/1000 ||
+			math.Hypot(tp.lastX-tp.startX, tp.lastY-tp.startY) > config.HoldMaxTravel {
+			return
+		}
+	}
+	chordHeld = make(map[int]bool, len(activeTouches))
+	for id := range activeTouches {
+		chordHeld[id] = true
+	}
+	Log("debug", fmt.Sprintf("Chord armed with %d held finger(s)", len(chordHeld)))
+}
+
+// detectChordTap dispatches "<held>hold_<taps>tap" for the fingers that
+// tapped while the chord's fingers are held. The chord is disarmed when a
+// held finger lifts or moves, or another finger lifts without tapping.
+func detectChordTap() {
+	for id := range chordHeld {
+		tp, active := activeTouches[id]
+		if !active || math.Hypot(tp.lastX-tp.startX, tp.lastY-tp.startY) > config.HoldMaxTravel {
+			Log("debug", "Chord disarmed, a held finger lifted or moved")
+			chordHeld = nil
+			return
+		}
+	}
+	var tapped []*TouchPoint
+	for _, tp := range finishedTouchesMap {
+		if tp.liftTime-tp.startTime > float64(config.ChordTapMaxMs)/1000 ||
+			math.Hypot(tp.lastX-tp.startX, tp.lastY-tp.startY) > config.HoldMaxTravel {
+			Log("debug", fmt.Sprintf("Chord disarmed, finger %d lifted without tapping", tp.id))
+			chordHeld = nil
+			return
+		}
+		tapped = append(tapped, tp)
+	}
+	if len(tapped) == 0 {
+		return
+	}
+	for _, tp := range tapped {
+		delete(finishedTouchesMap, tp.id)
+	}
+	// The held fingers lifting later must not make a gesture of their own.
+	gestureCancelled = true
+	g := Gesture{
+		Type:      "hold",
+		Count:     len(chordHeld),
+		Direction: fmt.Sprintf("%dtap", len(tapped)),
+	}
+	g.StartX, g.StartY = startCentroid(tapped)
+	g.EndX, g.EndY = endCentroid(tapped)
+	g.Key = gestureKey(g)
+	Log("info", fmt.Sprintf("Detected gesture: %s", g.Key))
+	dispatchGesture(g)
+}
+
+// detectRestingTap is called when a new finger appears. If every already
+// active finger has been down for RestingMinFrames frames without moving more
+// than RestingMaxTravel, it dispatches a "tap_with_<n>_resting" gesture.
+func detectRestingTap() {
+	if len(activeTouches) == 0 || wholeHand(len(activeTouches)+1) {
+		return
+	}
+	for _, tp := range activeTouches {
+		if tp.frames < config.RestingMinFrames ||
+			math.Hypot(tp.lastX-tp.startX, tp.lastY-tp.startY) > config.RestingMaxTravel {
+			return
+		}
+	}
+	resting := len(activeTouches)
+	key := fmt.Sprintf("tap_with_%d_resting", resting)
+	Log("info", fmt.Sprintf("Detected gesture: %s", key))
+	dispatchGesture(Gesture{Key: key, Type: "tap_with_resting", Count: resting + 1})
+}
+
+// processFrame is called whenever a TOUCH_FRAME event is received, with the
+// frame's event time. It assumes that any active touch that did not update
+// during the current frame has been lifted at that time.
+func processFrame(frameTime float64) {
+	frameCount++
+	// For each active touch not updated in this frame, mark it as finished.
+	for fingerID, tp := range activeTouches {
+		if _, updated := currentFrameUpdated[fingerID]; !updated {
+			tp.liftFrame = frameCount
+			tp.liftTime = max(frameTime, tp.lastTime)
+			finishedTouchesMap[fingerID] = tp
+			delete(activeTouches, fingerID)
+			Log("debug", fmt.Sprintf("Assuming finger %d lifted (no update in frame)", fingerID))
+			continue
+		}
+		tp.frames++
+	}
+	if chordHeld != nil {
+		detectChordTap()
+	}
+	trackCentroid()
+	if config.DirectionHysteresis > 0 {
+		trackDirection()
+	}
+	if config.HoldMinMs > 0 {
+		trackHold()
+	}
+	for fingerID := range stragglers {
+		if !currentFrameUpdated[fingerID] {
+			delete(stragglers, fingerID)
+		}
+	}
+	// Clear the update tracker for the next frame.
+	currentFrameUpdated = make(map[int]bool)
+
+	if config.LiftRatio > 0 && len(activeTouches) > 0 && len(finishedTouchesMap) > 0 {
+		completeOnLiftRatio(frameTime)
+	}
+
+	// When there are no active touches and we have finished touches, process the gesture.
+	if len(activeTouches) == 0 && len(finishedTouchesMap) > 0 && completionTimer == nil {
+		if config.CompleteDelayMs <= 0 {
+			completeGesture()
+			return
+		}
+		var timer *time.Timer
+		node := touchDevice
+		timer = time.AfterFunc(time.Duration(config.CompleteDelayMs)*time.Millisecond, func() {
+			eventMu.Lock()
+			defer eventMu.Unlock()
+			switchTouchDevice(node)
+			if completionTimer == timer {
+				completionTimer = nil
+				completeGesture()
+			}
+		})
+		completionTimer = timer
+	}
+}
+
+// completeGesture processes the finished touches as one gesture, or discards
+// them if the gesture was cancelled, and resets the per-gesture state.
+func completeGesture() {
+	var finishedTouches []*TouchPoint
+	for _, tp := range finishedTouchesMap {
+		finishedTouches = append(finishedTouches, tp)
+	}
+	if gestureCancelled {
+		Log("debug", "Discarding cancelled gesture")
+		gestureCancelled = false
+	} else if groups := splitTouches(finishedTouches); len(groups) > 1 {
+		Log("info", fmt.Sprintf("Splitting %d touches into %d gestures (splitDistance)", len(finishedTouches), len(groups)))
+		splitting, splitExecuted = true, false
+		for _, group := range groups {
+			processGesture(group)
+		}
+		splitting = false
+	} else {
+		processGesture(finishedTouches)
+	}
+	// Reset finished touches map for the next gesture.
+	finishedTouchesMap = make(map[int]*TouchPoint)
+	rawLines = nil
+	chordHeld = nil
+	centroidFingers = 0
+	liveDirection = ""
+}
+
+// splitTouches groups touches by SplitDistance, ordered left to right by
+// where they started. Without SplitDistance all touches form one group.
+func splitTouches(touches []*TouchPoint) [][]*TouchPoint {
+	if config.SplitDistance <= 0 || len(touches) < 2 || wholeHand(len(touches)) {
+		return [][]*TouchPoint{touches}
+	}
+	groups := clusterTouches(touches, config.SplitDistance)
+	slices.SortStableFunc(groups, func(a, b []*TouchPoint) int {
+		ax, _ := startCentroid(a)
+		bx, _ := startCentroid(b)
+		return cmp.Compare(ax, bx)
+	})
+	return groups
+}
+
+// stopCompletion cancels a pending CompleteDelayMs completion.
+func stopCompletion() {
+	if completionTimer != nil {
+		completionTimer.Stop()
+		completionTimer = nil
+	}
+}
+
+// flushCompletion completes a gesture whose CompleteDelayMs completion is
+// still pending, for callers that end before the delay elapses.
+func flushCompletion() {
+	if completionTimer != nil {
+		stopCompletion()
+		completeGesture()
+	}
+}
+
+// trackCentroid follows the centroid of the active fingers for the
+// "centroid" GestureVector. Tracking restarts whenever the number of fingers
+// down changes and stops once a finger of the gesture has lifted, so neither
+// staggered landing nor lift-off motion is counted.
+func trackCentroid() {
+	if len(finishedTouchesMap) > 0 || len(activeTouches) == 0 {
+		return
+	}
+	var x, y float64
+	for _, tp := range activeTouches {
+		x += tp.lastX
+		y += tp.lastY
+	}
+	n := float64(len(activeTouches))
+	x, y = x/n, y/n
+	if len(activeTouches) != centroidFingers {
+		centroidFingers = len(activeTouches)
+		centroidStartX, centroidStartY = x, y
+	}
+	centroidEndX, centroidEndY = x, y
+}
+
+// trackDirection updates liveDirection from the average travel of the active
+// fingers until the first of them lifts.
+func trackDirection() {
+	if len(finishedTouchesMap) > 0 || len(activeTouches) == 0 {
+		return
+	}
+	var dx, dy float64
+	for _, tp := range activeTouches {
+		dx += tp.lastX - tp.startX
+		dy += tp.lastY - tp.startY
+	}
+	n := float64(len(activeTouches))
+	dx, dy = dx/n, dy/n
+	if math.Hypot(dx, dy) < thresholdFor(len(activeTouches)) {
+		return
+	}
+	if direction := stickyDirection(liveDirection, dx, dy); direction != liveDirection {
+		Log("debug", fmt.Sprintf("Live direction now %s", direction))
+		liveDirection = direction
+	}
+}
+
+// trackHold dispatches "<n>hold_begin" once two or more fingers have rested
+// for HoldMinMs, and "<n>hold_end" as soon as one of them lifts, discarding
+// the rest of the gesture. It relies on the panel reporting the resting
+// fingers in every frame.
+func trackHold() {
+	if holdFingers > 0 {
+		if len(finishedTouchesMap) > 0 {
+			endHold()
+			gestureCancelled = true
+		}
+		return
+	}
+	if len(finishedTouchesMap) > 0 || len(activeTouches) < 2 {
+		return
+	}
+	var landed, latest float64
+	for _, tp := range activeTouches {
+		if math.Hypot(tp.lastX-tp.startX, tp.lastY-tp.startY) > config.HoldMaxTravel {
+			return
+		}
+		landed = max(landed, tp.startTime)
+		latest = max(latest, tp.lastTime)
+	}
+	if latest-landed < float64(config.HoldMinMs)/1000 {
+		return
+	}
+	holdFingers = len(activeTouches)
+	dispatchGesture(holdGesture("begin"))
+}
+
+// endHold dispatches the end of the hold in progress.
+func endHold() {
+	g := holdGesture("end")
+	holdFingers = 0
+	dispatchGesture(g)
+}
+
+// holdGesture describes the hold in progress at the given phase ("begin" or
+// "end").
+func holdGesture(phase string) Gesture {
+	var touches []*TouchPoint
+	for _, tp := range activeTouches {
+		touches = append(touches, tp)
+	}
+	for _, tp := range finishedTouchesMap {
+		touches = append(touches, tp)
+	}
+	g := Gesture{Type: "hold", Count: holdFingers, Direction: phase}
+	if len(touches) > 0 {
+		g.StartX, g.StartY = startCentroid(touches)
+		g.EndX, g.EndY = endCentroid(touches)
+	}
+	g.Key = gestureKey(g)
+	Log("info", fmt.Sprintf("Detected gesture: %s", g.Key))
+	return g
+}
+
+// completeOnLiftRatio finishes the gesture early when at least LiftRatio of
+// its fingers lifted within the last LiftWindowFrames frames. The fingers
+// still down complete with the others where they are at frameTime, and
+// their further motion is ignored until they lift.
+func completeOnLiftRatio(frameTime float64) {
+	window := max(config.LiftWindowFrames, 1)
+	lifted := 0
+	for _, tp := range finishedTouchesMap {
+		if tp.liftFrame > frameCount-window {
+			lifted++
+		}
+	}
+	total := len(finishedTouchesMap) + len(activeTouches)
+	if wholeHand(total) || float64(lifted) < config.LiftRatio*float64(total) {
+		return
+	}
+	Log("debug", fmt.Sprintf("%d of %d fingers lifted together, completing %d straggler(s) with them", lifted, total, len(activeTouches)))
+	for fingerID, tp := range activeTouches {
+		tp.liftFrame = frameCount
+		tp.liftTime = max(frameTime, tp.lastTime)
+		finishedTouchesMap[fingerID] = tp
+		stragglers[fingerID] = true
+		delete(activeTouches, fingerID)
+	}
+}
+
+// maxSpreadFor returns the MaxSpread of the current device.
+func maxSpreadFor() float64 {
+	if device, ok := currentDeviceConfig(); ok && device.MaxSpread > 0 {
+		return device.MaxSpread
+	}
+	return config.MaxSpread
+}
+
+// averageSpread returns the average distance between each pair of touches
+// where they landed.
+func averageSpread(touches []*TouchPoint) float64 {
+	var total float64
+	pairs := 0
+	for i, a := range touches {
+		for _, b := range touches[i+1:] {
+			total += math.Hypot(a.startX-b.startX, a.startY-b.startY)
+			pairs++
+		}
+	}
+	if pairs == 0 {
+		return 0
+	}
+	return total / float64(pairs)
+}
+
+// dragging reports whether gestures are suppressed by SuppressWhileDragging
+// because a pointer button is held.
+func dragging() bool {
+	if config.SuppressWhileDragging && len(heldButtons) > 0 {
+		Log("debug", "Pointer button held, gesture ignored")
+		return true
+	}
+	return false
+}
+
+// wholeHand reports whether a touch with count fingers is exempt from the
+// few-finger heuristics under WholeHandFingers.
+func wholeHand(count int) bool {
+	return config.WholeHandFingers > 0 && count >= config.WholeHandFingers
+}
+
+// cancelGesture discards the gesture in progress, if any. Fingers still down
+// keep being tracked so that they do not start a new gesture mid-motion, but
+// nothing is dispatched when they lift.
+func cancelGesture(reason string) {
+	if len(activeTouches) == 0 && len(finishedTouchesMap) == 0 {
+		return
+	}
+	if !gestureCancelled {
+		Log("info", fmt.Sprintf("Gesture cancelled: %s", reason))
+	}
+	gestureCancelled = true
+}
+
+// processGesture computes the overall movement based on the finished touches.
+// It averages the deltas (last - start) for each finger and, if the movement
+// exceeds the threshold, determines the dominant swipe direction and executes
+// the corresponding command from the config.
+func processGesture(touches []*TouchPoint) {
+	count := len(touches)
+	if !fingerCountAllowed(count) || dragging() {
+		return
+	}
+	if maxSpread := maxSpreadFor(); maxSpread > 0 && count >= 2 && !wholeHand(count) {
+		if spread := averageSpread(touches); spread > maxSpread {
+			Log("info", fmt.Sprintf("Ignoring %d-finger touch spread %s wide, likely a palm", count, formatFloat(spread)))
+			return
+		}
+	}
+	var totalDx, totalDy float64
+	for _, tp := range touches {
+		dx := tp.lastX - tp.startX
+		dy := tp.lastY - tp.startY
+		totalDx += dx
+		totalDy += dy
+	}
+	avgDx := totalDx / float64(count)
+	avgDy := totalDy / float64(count)
+	Log("info", fmt.Sprintf("Gesture completed with %d finger(s): avg dx=%s, avg dy=%s", count, formatFloat(avgDx), formatFloat(avgDy)))
+	if config.GestureVector == "centroid" && centroidFingers > 0 {
+		avgDx, avgDy = centroidEndX-centroidStartX, centroidEndY-centroidStartY
+		Log("debug", fmt.Sprintf("Centroid of %d finger(s) moved dx=%s, dy=%s", centroidFingers, formatFloat(avgDx), formatFloat(avgDy)))
+	}
+	if config.GestureVector == "weighted" {
+		if dx, dy, ok := weightedTravel(touches); ok {
+			avgDx, avgDy = dx, dy
+			Log("debug", fmt.Sprintf("Travel weighted by length: dx=%s, dy=%s", formatFloat(avgDx), formatFloat(avgDy)))
+		}
+	}
+
+	duration := gestureDuration(touches)
+	if config.LearningMode {
+		recordSample(count, math.Hypot(avgDx, avgDy), duration)
+	}
+
+	startX, startY := startCentroid(touches)
+	endX, endY := endCentroid(touches)
+	var fingers []FingerPosition
+	if config.FingerPositions {
+		fingers = fingerPositions(touches)
+	}
+
+	// Two hands are recognized first, as moving them apart would otherwise
+	// look like a pinch.
+	if count >= 2 && config.ClusterDistance > 0 && !wholeHand(count) {
+		if g, ok := classifyTwoHanded(touches, duration); ok {
+			if tooFewSamples(touches) {
+				return
+			}
+			g.StartX, g.StartY, g.EndX, g.EndY = startX, startY, endX, endY
+			g.Fingers = fingers
+			Log("info", fmt.Sprintf("Detected gesture: %s", g.Key))
+			dispatchGesture(g)
+			return
+		}
+	}
+
+	// Pinch and rotation take precedence: fingers moving symmetrically
+	// around the centroid barely move it.
+	if count >= 2 && (config.PinchThreshold > 0 || config.RotateThreshold > 0) {
+		if g, ok := classifyPinchRotate(touches); ok {
+			if tooFewSamples(touches) {
+				return
+			}
+			g.StartX, g.StartY, g.EndX, g.EndY = startX, startY, endX, endY
+			g.Fingers = fingers
+			g.Key = gestureKey(g)
+			Log("info", fmt.Sprintf("Detected gesture: %s (scale=%s, angle=%s)", g.Key, formatFloat(g.Scale), formatFloat(g.Angle)))
+			dispatchGesture(g)
+			return
+		}
+	}
+
+	if config.PathCornerAngle > 0 {
+		if legs := pathLegs(touches); len(legs) >= 2 {
+			if tooFewSamples(touches) {
+				return
+			}
+			g := Gesture{Type: "path", Count: count, Direction: strings.Join(legs, "_"), Dx: avgDx, Dy: avgDy, StartX: startX, StartY: startY, EndX: endX, EndY: endY, Fingers: fingers}
+			g.Key = gestureKey(g)
+			Log("info", fmt.Sprintf("Detected gesture: %s", g.Key))
+			dispatchGesture(g)
+			return
+		}
+	}
+
+	// Below the threshold, touches lifted within TapMaxMs are taps and
+	// anything else is ignored; above it they are swipes.
+	if belowThreshold(count, avgDx, avgDy) {
+		if config.TapMaxMs <= 0 {
+			Log("debug", "Movement below threshold, gesture ignored")
+			return
+		}
+		if lifetime := touchLifetime(touches); lifetime > float64(config.TapMaxMs)/1000 {
+			Log("debug", fmt.Sprintf("Movement below threshold but lifted after %.3fs, longer than tapMaxMs, gesture ignored", lifetime))
+			return
+		}
+		registerTap(Gesture{Type: "tap", Count: count, Dx: avgDx, Dy: avgDy, StartX: startX, StartY: startY, EndX: endX, EndY: endY, Fingers: fingers, Taps: 1})
+		return
+	}
+
+	if tooFewSamples(touches) {
+		return
+	}
+	if length := averagePathLength(touches); config.PathLengthThreshold > 0 && length < config.PathLengthThreshold {
+		Log("debug", fmt.Sprintf("Fingers travelled %s along their paths, less than pathLengthThreshold, gesture ignored", formatFloat(length)))
+		return
+	}
+	direction := classifySwipe(count, avgDx, avgDy, duration)
+	if direction == "" {
+		return
+	}
+	if config.AdaptiveThreshold {
+		recordTravel(math.Hypot(avgDx, avgDy))
+	}
+	if liveDirection != "" {
+		if sticky := stickyDirection(liveDirection, avgDx, avgDy); sticky != direction && !slices.Contains(config.DisabledDirections, sticky) {
+			Log("debug", fmt.Sprintf("Keeping direction %s instead of %s (directionHysteresis)", sticky, direction))
+			direction = sticky
+		}
+	}
+	g := Gesture{
+		Type:      "swipe",
+		Count:     count,
+		Direction: direction,
+		Dx:        avgDx,
+		Dy:        avgDy,
+		StartX:    startX,
+		StartY:    startY,
+		EndX:      endX,
+		EndY:      endY,
+		Fingers:   fingers,
+	}
+	g.Key = gestureKey(g)
+	if offEdge(direction, endX, endY) {
+		off := g
+		off.Type = "swipeoff"
+		off.Key = gestureKey(off)
+		if _, ok := lookupAction(off.Key); ok {
+			g = off
+		}
+	}
+	if len(config.SpeedZones) > 0 && duration > 0 {
+		g.Speed = math.Hypot(avgDx, avgDy) / duration
+		g.Zone = speedZone(g.Speed)
+		if banded := g.Key + "@" + g.Zone; g.Zone != "" {
+			if _, ok := lookupAction(banded); ok {
+				g.Key = banded
+			}
+		}
+	}
+	Log("info", fmt.Sprintf("Detected gesture: %s", g.Key))
+	if config.SnapToNearest {
+		g = snapToNearest(g)
+	}
+	dispatchGesture(g)
+}
+
+var (
+	// pendingTap is the tap sequence waiting for MultiTapWindowMs to pass
+	// without another tap, or nil.
+	pendingTap *Gesture
+	// tapTimer dispatches pendingTap when the window expires.
+	tapTimer *time.Timer
+)
+
+// registerTap chains the tap g to the pending tap sequence if it has the same
+// finger count, or starts a new sequence after dispatching the pending one.
+// The sequence is dispatched when MultiTapWindowMs passes without another
+// tap or when it reaches MultiTapMax taps.
+func registerTap(g Gesture) {
+	if config.MultiTapWindowMs <= 0 {
+		dispatchTap(g)
+		return
+	}
+	g.rawLines = takeRawLines()
+	if pendingTap != nil && pendingTap.Count == g.Count {
+		g.Taps = pendingTap.Taps + 1
+		g.rawLines = append(pendingTap.rawLines, g.rawLines...)
+		pendingTap = nil
+		tapTimer.Stop()
+		tapTimer = nil
+	} else {
+		flushTaps()
+	}
+	if g.Taps >= max(config.MultiTapMax, 1) {
+		dispatchTap(g)
+		return
+	}
+	Log("debug", fmt.Sprintf("%d-finger tap %d, waiting for another one", g.Count, g.Taps))
+	pendingTap = &g
+	var timer *time.Timer
+	timer = time.AfterFunc(time.Duration(config.MultiTapWindowMs)*time.Millisecond, func() {
+		eventMu.Lock()
+		defer eventMu.Unlock()
+		if tapTimer == timer {
+			flushTaps()
+		}
+	})
+	tapTimer = timer
+}
+
+// flushTaps dispatches the pending tap sequence, if any.
+func flushTaps() {
+	if pendingTap == nil {
+		return
+	}
+	g := *pendingTap
+	pendingTap = nil
+	tapTimer.Stop()
+	tapTimer = nil
+	dispatchTap(g)
+}
+
+// dispatchTap dispatches a sequence of g.Taps taps, keyed "<n>tap" for a
+// single tap and "<n>tap_x<taps>" for more.
+func dispatchTap(g Gesture) {
+	if g.Taps > 1 {
+		g.Direction = fmt.Sprintf("x%d", g.Taps)
+	}
+	g.Key = gestureKey(g)
+	Log("info", fmt.Sprintf("Detected gesture: %s", g.Key))
+	dispatchGesture(g)
+}
+
+// maxPathPoints bounds the recorded path of a finger; later motion is not
+// recorded.
+const maxPathPoints = 4096
+
+// pathSpacing is the minimum distance between recorded path points, which
+// keeps jitter out of the path.
+const pathSpacing = 0.5
+
+// recordPathPoint appends the finger's current position to its path.
+func recordPathPoint(tp *TouchPoint) {
+	if n := len(tp.path); n > 0 && (n >= maxPathPoints ||
+		math.Hypot(tp.lastX-tp.path[n-1].x, tp.lastY-tp.path[n-1].y) < pathSpacing) {
+		return
+	}
+	tp.path = append(tp.path, pathPoint{tp.lastX, tp.lastY})
+}
+
+// pathLegs splits the path of the finger that travelled furthest into legs
+// and returns their directions. The path is resampled into steps of half
+// PathMinLeg; consecutive steps stay in the same leg while their heading is
+// within PathCornerAngle of the leg's first step. Legs shorter than
+// PathMinLeg are dropped and neighbouring legs with the same direction
+// merged.
+func pathLegs(touches []*TouchPoint) []string {
+	var path []pathPoint
+	var longest float64
+	for _, tp := range touches {
+		var length float64
+		for i := 1; i < len(tp.path); i++ {
+			length += math.Hypot(tp.path[i].x-tp.path[i-1].x, tp.path[i].y-tp.path[i-1].y)
+		}
+		if length > longest {
+			path, longest = tp.path, length
+		}
+	}
+	if len(path) < 2 || config.PathMinLeg <= 0 {
+		return nil
+	}
+
+	// Resample into roughly equal steps.
+	step := config.PathMinLeg / 2
+	samples := []pathPoint{path[0]}
+	for _, p := range path[1:] {
+		last := samples[len(samples)-1]
+		if math.Hypot(p.x-last.x, p.y-last.y) >= step {
+			samples = append(samples, p)
+		}
+	}
+
+	var legs []string
+	legStart, legHeading := 0, 0.0
+	closeLeg := func(end int) {
+		dx, dy := samples[end].x-samples[legStart].x, samples[end].y-samples[legStart].y
+		if math.Hypot(dx, dy) < config.PathMinLeg {
+			return
+		}
+		if direction := swipeDirection(dx, dy); len(legs) == 0 || legs[len(legs)-1] != direction {
+			legs = append(legs, direction)
+		}
+	}
+	for i := 1; i < len(samples); i++ {
+		heading := math.Atan2(samples[i].y-samples[i-1].y, samples[i].x-samples[i-1].x) * 180 / math.Pi
+		if i-1 == legStart {
+			legHeading = heading
+			continue
+		}
+		if turn := math.Abs(math.Remainder(heading-legHeading, 360)); turn >= config.PathCornerAngle {
+			closeLeg(i - 1)
+			legStart, legHeading = i-1, heading
+		}
+	}
+	closeLeg(len(samples) - 1)
+	return legs
+}
+
+// minPinchRadius is the smallest mean finger distance from the centroid for
+// which scale and rotation are computed; closer fingers make them noisy.
+const minPinchRadius = 2.0
+
+// classifyPinchRotate computes how the fingers scaled and rotated around
+// their centroid. It returns a "pinch" gesture (direction "in" or "out"), a
+// "rotate" gesture ("cw" or "ccw"), or, when both exceed their thresholds, a
+// combined "pinch" gesture with direction "rotate" (e.g. "2pinch_rotate").
+func classifyPinchRotate(touches []*TouchPoint) (Gesture, bool) {
+	scale, angle, ok := pinchRotation(touches)
+	if !ok {
+		return Gesture{}, false
+	}
+	pinched := config.PinchThreshold > 0 && math.Abs(scale-1) >= config.PinchThreshold
+	rotated := config.RotateThreshold > 0 && math.Abs(angle) >= config.RotateThreshold
+	g := Gesture{Count: len(touches), Scale: scale, Angle: angle}
+	switch {
+	case pinched && rotated:
+		g.Type, g.Direction = "pinch", "rotate"
+	case pinched && scale < 1:
+		g.Type, g.Direction = "pinch", "in"
+	case pinched:
+		g.Type, g.Direction = "pinch", "out"
+	case rotated && angle > 0:
+		g.Type, g.Direction = "rotate", "cw"
+	case rotated:
+		g.Type, g.Direction = "rotate", "ccw"
+	default:
+		return Gesture{}, false
+	}
+	return g, true
+}
+
+// pinchRotation returns the scale factor (mean distance from the centroid at
+// the end divided by that at the start) and the mean rotation in degrees
+// (positive is clockwise on screen) of touches around their centroid.
+func pinchRotation(touches []*TouchPoint) (scale, angle float64, ok bool) {
+	sx, sy := startCentroid(touches)
+	ex, ey := endCentroid(touches)
+	var startRadius, endRadius, rotation float64
+	for _, tp := range touches {
+		startRadius += math.Hypot(tp.startX-sx, tp.startY-sy)
+		endRadius += math.Hypot(tp.lastX-ex, tp.lastY-ey)
+		delta := math.Atan2(tp.lastY-ey, tp.lastX-ex) - math.Atan2(tp.startY-sy, tp.startX-sx)
+		// Normalize to (-pi, pi].
+		delta = math.Mod(delta+3*math.Pi, 2*math.Pi) - math.Pi
+		rotation += delta
+	}
+	n := float64(len(touches))
+	if startRadius/n < minPinchRadius {
+		return 0, 0, false
+	}
+	return endRadius / startRadius, rotation / n * 180 / math.Pi, true
+}
+
+// clusterTouches groups touches whose start positions are linked by steps of
+// at most distance (single-linkage clustering).
+func clusterTouches(touches []*TouchPoint, distance float64) [][]*TouchPoint {
+	var clusters [][]*TouchPoint
+	assigned := make([]bool, len(touches))
+	for i := range touches {
+		if assigned[i] {
+			continue
+		}
+		assigned[i] = true
+		cluster := []*TouchPoint{touches[i]}
+		for next := 0; next < len(cluster); next++ {
+			for j, tp := range touches {
+				if !assigned[j] && math.Hypot(tp.startX-cluster[next].startX, tp.startY-cluster[next].startY) <= distance {
+					assigned[j] = true
+					cluster = append(cluster, tp)
+				}
+			}
+		}
+		clusters = append(clusters, cluster)
+	}
+	return clusters
+}
+
+// classifyTwoHanded recognizes touches forming exactly two clusters as a
+// two-handed gesture keyed by twoHandedKey, e.g. "2+2swipe_<dir>": "apart" or
+// "together" when the clusters' distance changed by at least the threshold,
+// otherwise the direction both clusters swiped in. Clusters swiping in
+// different directions give "<left dir>_<right dir>" if that key is mapped.
+func classifyTwoHanded(touches []*TouchPoint, duration float64) (Gesture, bool) {
+	clusters := clusterTouches(touches, config.ClusterDistance)
+	if len(clusters) != 2 {
+		return Gesture{}, false
+	}
+	left, right := clusters[0], clusters[1]
+	lsx, lsy := startCentroid(left)
+	rsx, rsy := startCentroid(right)
+	if rsx < lsx {
+		left, right = right, left
+		lsx, lsy, rsx, rsy = rsx, rsy, lsx, lsy
+	}
+	lex, ley := endCentroid(left)
+	rex, rey := endCentroid(right)
+	spread := math.Hypot(rex-lex, rey-ley) - math.Hypot(rsx-lsx, rsy-lsy)
+	Log("debug", fmt.Sprintf("Two-handed gesture with %d+%d finger(s): spread changed by %s", len(left), len(right), formatFloat(spread)))
+
+	var direction string
+	switch threshold := thresholdFor(len(touches)); {
+	case spread >= threshold:
+		direction = "apart"
+	case spread <= -threshold:
+		direction = "together"
+	default:
+		leftDir := classifySwipe(len(left), lex-lsx, ley-lsy, duration)
+		rightDir := classifySwipe(len(right), rex-rsx, rey-rsy, duration)
+		if leftDir == "" || rightDir == "" {
+			return Gesture{}, false
+		}
+		direction = leftDir
+		if leftDir != rightDir {
+			// Opposite motions are left to rotation and swipes unless
+			// bound explicitly.
+			direction = leftDir + "_" + rightDir
+			if _, ok := lookupAction(twoHandedKey(len(left), len(right), direction)); !ok {
+				return Gesture{}, false
+			}
+		}
+	}
+	g := Gesture{
+		Key:       twoHandedKey(len(left), len(right), direction),
+		Type:      "swipe",
+		Count:     len(touches),
+		Direction: direction,
+		Dx:        (lex - lsx + rex - rsx) / 2,
+		Dy:        (ley - lsy + rey - rsy) / 2,
+	}
+	return g, true
+}
+
+// twoHandedKey returns the key of a two-handed swipe in direction: the left
+// hand's finger count and "+", followed by the key of the right hand's swipe,
+// so that KeyFormat applies.
+func twoHandedKey(left, right int, direction string) string {
+	return fmt.Sprintf("%d+%s", left, gestureKey(Gesture{Type: "swipe", Count: right, Direction: direction}))
+}
+
+// classifySwipe decides whether a movement of count fingers by (dx, dy) over
+// duration seconds is a swipe. It returns the dominant direction, or "" if
+// the movement took too long, stayed below the threshold or is in a disabled
+// direction.
+func classifySwipe(count int, dx, dy, duration float64) string {
+	// Reject long, meandering interactions.
+	if config.MaxGestureDurationMs > 0 && duration > float64(config.MaxGestureDurationMs)/1000 {
+		Log("debug", fmt.Sprintf("Gesture lasted %.3fs, longer than maxGestureDurationMs, not a swipe", duration))
+		return ""
+	}
+
+	// Ignore minor movements.
+	if belowThreshold(count, dx, dy) {
+		Log("debug", "Movement below threshold, gesture ignored")
+		return ""
+	}
+
+	direction := swipeDirection(dx, dy)
+	if slices.Contains(config.DisabledDirections, direction) {
+		Log("debug", fmt.Sprintf("Direction %s is disabled, gesture ignored", direction))
+		return ""
+	}
+	return direction
+}
+
+// offEdge reports whether a swipe in direction ending at (x, y) reached
+// EdgeMargin of the border it moved toward.
+func offEdge(direction string, x, y float64) bool {
+	margin := config.EdgeMargin
+	switch direction {
+	case "left":
+		return x <= margin
+	case "right":
+		return x >= 100-margin
+	case "up":
+		return y <= margin
+	case "down":
+		return y >= 100-margin
+	}
+	return false
+}
+
+// speedZone returns the name of the SpeedZones band that speed falls into,
+// or "" if it is slower than all of them.
+func speedZone(speed float64) string {
+	zone := ""
+	for _, z := range config.SpeedZones {
+		if speed >= z.Min {
+			zone = z.Name
+		}
+	}
+	return zone
+}
+
+// belowThreshold reports whether a motion of (dx, dy) by count fingers is
+// too small to be a swipe.
+func belowThreshold(count int, dx, dy float64) bool {
+	threshold := thresholdFor(count)
+	return math.Abs(dx) < threshold && math.Abs(dy) < threshold
+}
+
+// directionAngles are the angles of the swipe directions in degrees, with y
+// growing downwards as in device coordinates.
+var directionAngles = map[string]float64{"right": 0, "down": 90, "left": 180, "up": 270}
+
+// snapToNearest replaces an unmapped swipe with the mapped swipe of the same
+// finger count whose direction is angularly closest to the movement, within
+// 90 degrees. g is returned unchanged if there is none.
+func snapToNearest(g Gesture) Gesture {
+	if _, ok := lookupAction(g.Key); ok {
+		return g
+	}
+	angle := math.Atan2(g.Dy, g.Dx) * 180 / math.Pi
+	best, bestDistance := g, 90.0
+	for _, direction := range slices.Sorted(maps.Keys(directionAngles)) {
+		if slices.Contains(config.DisabledDirections, direction) {
+			continue
+		}
+		candidate := g
+		candidate.Direction = direction
+		candidate.Key = gestureKey(candidate)
+		if _, ok := lookupAction(candidate.Key); !ok {
+			continue
+		}
+		distance := math.Abs(math.Mod(angle-directionAngles[direction]+540, 360) - 180)
+		if distance < bestDistance {
+			best, bestDistance = candidate, distance
+		}
+	}
+	if best.Key != g.Key {
+		Log("info", fmt.Sprintf("Snapped unmapped %s to %s (%.0f degrees off)", g.Key, best.Key, bestDistance))
+	}
+	return best
+}
+
+// stickyDirection returns the swipe direction of (dx, dy), but keeps
+// previous unless the movement is more than DirectionHysteresis/2 degrees
+// past the boundary between previous and its neighbor.
+func stickyDirection(previous string, dx, dy float64) string {
+	direction := swipeDirection(dx, dy)
+	if previous == "" || direction == previous || config.DirectionHysteresis <= 0 {
+		return direction
+	}
+	angle := math.Atan2(dy, dx) * 180 / math.Pi
+	if math.Abs(math.Mod(angle-directionAngles[previous]+540, 360)-180) < 45+config.DirectionHysteresis/2 {
+		return previous
+	}
+	return direction
+}
+
+// swipeDirection returns the dominant direction of the movement (dx, dy).
+func swipeDirection(dx, dy float64) string {
+	if math.Abs(dx) > math.Abs(dy) {
+		if dx > 0 {
+			return "right"
+		}
+		return "left"
+	}
+	if dy > 0 {
+		return "down"
+	}
+	return "up"
+}
+
+// gestureKey builds the lookup key for g from the configured KeyFormat. A
+// trailing "_" left by an empty placeholder, such as the direction of a tap,
+// is dropped.
+func gestureKey(g Gesture) string {
+	fields := g.fields()
+	if alias, ok := config.GestureAliases[g.Type+"_"+g.Direction]; ok {
+		fields["type"], fields["dir"], _ = strings.Cut(alias, "_")
+	}
+	return strings.TrimRight(expandTemplate(config.KeyFormat, fields), "_")
+}
+
+// aliasableGestures are the gesture names GestureAliases may rename.
+var aliasableGestures = []string{"pinch_in", "pinch_out", "pinch_rotate", "rotate_cw", "rotate_ccw"}
+
+// validateGestureAliases drops GestureAliases entries that do not rename a
+// known gesture to a unique, non-empty name, and warns about mapped keys
+// that an alias makes unreachable.
+func validateGestureAliases() {
+	aliased := make(map[string]string)
+	for _, name := range slices.Sorted(maps.Keys(config.GestureAliases)) {
+		alias := config.GestureAliases[name]
+		switch {
+		case !slices.Contains(aliasableGestures, name):
+			Log("error", fmt.Sprintf("Invalid gestureAliases entry %q: not one of %s, ignoring it", name, strings.Join(aliasableGestures, ", ")))
+		case alias == "" || strings.ContainsAny(alias, ",@ "):
+			Log("error", fmt.Sprintf("Invalid gestureAliases name %q for %s, ignoring it", alias, name))
+		case aliased[alias] != "":
+			Log("error", fmt.Sprintf("Alias %q is used for both %s and %s, ignoring it for %s", alias, aliased[alias], name, name))
+		default:
+			aliased[alias] = name
+			continue
+		}
+		delete(config.GestureAliases, name)
+	}
+	for key := range config.GestureActions {
+		if name := strings.TrimLeft(key, "0123456789"); name != key && config.GestureAliases[name] != "" {
+			Log("warn", fmt.Sprintf("Gesture %s is never detected as it is renamed to %s by gestureAliases", key, config.GestureAliases[name]))
+		}
+	}
+}
+
+// fingerCountAllowed reports whether gestures with count fingers are
+// recognized under MinFingers and MaxFingers.
+func fingerCountAllowed(count int) bool {
+	if count < config.MinFingers || (config.MaxFingers > 0 && count > config.MaxFingers) {
+		Log("debug", fmt.Sprintf("Ignoring %d-finger interaction outside minFingers/maxFingers", count))
+		return false
+	}
+	return true
+}
+
+// startCentroid returns the mean start position of touches.
+func startCentroid(touches []*TouchPoint) (float64, float64) {
+	var x, y float64
+	for _, tp := range touches {
+		x += tp.startX
+		y += tp.startY
+	}
+	n := float64(len(touches))
+	return x / n, y / n
+}
+
+// endCentroid returns the mean last position of touches.
+func endCentroid(touches []*TouchPoint) (float64, float64) {
+	var x, y float64
+	for _, tp := range touches {
+		x += tp.lastX
+		y += tp.lastY
+	}
+	n := float64(len(touches))
+	return x / n, y / n
+}
+
+// maxSequenceLength bounds the number of gestures in a sequence.
+const maxSequenceLength = 8
+
+var (
+	// recentGestures are the keys of the gestures of the sequence in
+	// progress, and lastSequenceAt is when the last of them was dispatched.
+	recentGestures []string
+	lastSequenceAt time.Time
+)
+
+// matchSequence adds g to the sequence in progress, starting a new one if
+// SequenceWindowMs passed since the previous gesture, and returns the
+// longest mapped sequence that g completes as a "sequence" gesture.
+func matchSequence(g Gesture) (Gesture, bool) {
+	if config.SequenceWindowMs <= 0 || g.Type == "sequence" || g.Type == "hold" && (g.Direction == "begin" || g.Direction == "end") {
+		return Gesture{}, false
+	}
+	if time.Since(lastSequenceAt) > time.Duration(config.SequenceWindowMs)*time.Millisecond {
+		recentGestures = recentGestures[:0]
+	}
+	lastSequenceAt = time.Now()
+	recentGestures = append(recentGestures, g.Key)
+	if len(recentGestures) > maxSequenceLength {
+		recentGestures = recentGestures[1:]
+	}
+	for i := 0; i < len(recentGestures)-1; i++ {
+		key := strings.Join(recentGestures[i:], ",")
+		if _, ok := lookupAction(key); ok {
+			recentGestures = recentGestures[:0]
+			g.Type, g.Key = "sequence", key
+			return g, true
+		}
+	}
+	return Gesture{}, false
+}
+
+// dispatchGesture emits g if configured and runs the action mapped to it.
+func dispatchGesture(g Gesture) {
+	// A tap sequence in progress ends with any other gesture.
+	if pendingTap != nil && g.Type != "tap" {
+		flushTaps()
+	}
+	if seq, ok := matchSequence(g); ok {
+		Log("info", fmt.Sprintf("Detected gesture sequence: %s", seq.Key))
+		dispatchGesture(seq)
+		return
+	}
+	if config.LogLatency {
+		g.lastInputAt, g.detectedAt = lastInputAt, time.Now()
+	}
+	if config.RawLinesPath != "" {
+		if g.rawLines == nil {
+			g.rawLines = takeRawLines()
+		}
+		writeRawLines(g)
+	}
+	if replayedKeys != nil && !replayGated {
+		*replayedKeys = append(*replayedKeys, g.Key)
+		return
+	}
+	if onceMode {
+		if onceDone {
+			return
+		}
+		onceDone = true
+		defer exitAfterGesture()
+	}
+	// dispatched is set once the gesture is handed to the DispatcherCommand,
+	// which counts and logs it when it exits.
+	executed, dispatched := false, false
+	defer func() {
+		if !dispatched {
+			logGestureCSV(g, executed)
+		}
+	}()
+	gesturesDetected.Add(1)
+	lastGestureAt = time.Now()
+	// The end of a hold must reach the action that handled its begin.
+	holdEnd := g.Type == "hold" && g.Direction == "end"
+	sibling := splitting && splitExecuted
+	if config.MultiDeviceMode == "coalesce" && g.Key == lastExecutedKey && currentDevice != lastExecutedDevice &&
+		time.Since(lastExecutedAt) < time.Duration(config.MultiDeviceWindowMs)*time.Millisecond {
+		Log("info", fmt.Sprintf("Coalescing %s from %s with the same gesture from %s", g.Key, currentDevice, lastExecutedDevice))
+		return
+	}
+	if !holdEnd && !sibling && isResidual(g) {
+		Log("info", fmt.Sprintf("Ignoring %s as residual lift-off from the previous gesture", g.Key))
+		return
+	}
+	if settle := time.Duration(config.PostGestureSettleMs) * time.Millisecond; !holdEnd && !sibling && sameDeviceAsExecuted() && time.Since(lastExecutedAt) < settle {
+		Log("info", fmt.Sprintf("Ignoring %s within postGestureSettleMs of the previous gesture", g.Key))
+		return
+	}
+	if emitOnly {
+		emitGesture(g)
+		return
+	}
+	if armedKey != "" && armedKey != g.Key {
+		Log("info", fmt.Sprintf("Gesture %s disarmed by %s", armedKey, g.Key))
+		armedKey = ""
+	}
+	action, exists := lookupAction(g.Key)
+	if layerPushed {
+		popLayer()
+	}
+	if config.EmitAll || (config.Emit && !exists) {
+		emitGesture(g)
+	}
+	if !exists && config.DispatcherCommand == "" {
+		Log("warn", fmt.Sprintf("No action mapped for gesture: %s", g.Key))
+		return
+	}
+	if !modeAllows(g.Key, action) {
+		Log("info", fmt.Sprintf("Gesture %s disabled in mode %s", g.Key, activeMode))
+		return
+	}
+	if reason := inhibitReason(g.Key); reason != "" {
+		Log("info", fmt.Sprintf("Gesture %s inhibited: %s", g.Key, reason))
+		return
+	}
+	if exists && action.RequireConfirm && !confirmGesture(g, action) {
+		return
+	}
+	if exists && action.MinIntervalMs > 0 {
+		interval := time.Duration(action.MinIntervalMs) * time.Millisecond
+		if since := time.Since(lastFiredAt[g.Key]); since < interval {
+			Log("info", fmt.Sprintf("Gesture %s rate limited, %dms of cooldown remaining", g.Key, (interval-since).Milliseconds()))
+			return
+		}
+	}
+	if exists && action.BusyGraceMs > 0 {
+		if running, remaining := commandBusy(g.Key); running {
+			Log("info", fmt.Sprintf("Gesture %s dropped, its previous command is still running", g.Key))
+			return
+		} else if remaining > 0 {
+			Log("info", fmt.Sprintf("Gesture %s dropped, %dms of busyGraceMs remaining", g.Key, remaining.Milliseconds()))
+			return
+		}
+	}
+	if replayedKeys != nil {
+		if exists && action.MinIntervalMs > 0 {
+			lastFiredAt[g.Key] = time.Now()
+		}
+		noteExecuted(g)
+		*replayedKeys = append(*replayedKeys, g.Key)
+		return
+	}
+	if sound := cmp.Or(action.FeedbackSound, config.FeedbackSound); exists && sound != "off" && sound != "" {
+		commandsWG.Add(1)
+		go func() {
+			defer commandsWG.Done()
+			playSound(sound)
+		}()
+	}
+	var actionRan chan bool
+	if config.DispatcherCommand != "" {
+		// The gesture was executed if the dispatcher exits successfully or
+		// its mapped action ran.
+		dispatched, actionRan = true, make(chan bool, 1)
+		commandsWG.Add(1)
+		go func() {
+			defer commandsWG.Done()
+			ok := runDispatcher(g)
+			if <-actionRan || ok {
+				gesturesExecuted.Add(1)
+				ok = true
+			}
+			logGestureCSV(g, ok)
+		}()
+	}
+	if exists && runAction(action, g) {
+		if action.MinIntervalMs > 0 {
+			lastFiredAt[g.Key] = time.Now()
+		}
+		executed = true
+	}
+	// Follow-up gestures are suppressed from the hand-off on, as the
+	// dispatcher may take a while to exit.
+	if executed || dispatched {
+		noteExecuted(g)
+	}
+	if dispatched {
+		actionRan <- executed
+	} else if executed {
+		gesturesExecuted.Add(1)
+	}
+}
+
+// runDispatcher pipes g as JSON to the DispatcherCommand and waits for it to
+// exit, logging the exit status. It reports whether the dispatcher succeeded.
+func runDispatcher(g Gesture) bool {
+	payload, err := json.Marshal(struct {
+		Gesture
+		Time string `json:"time"`
+	}{g, time.Now().Format(time.RFC3339Nano)})
+	if err != nil {
+		Log("error", fmt.Sprintf("Error encoding gesture for dispatcher: %v", err))
+		return false
+	}
+	command := liveConfig().DispatcherCommand
+	Log("debug", fmt.Sprintf("Dispatching %s to %s", g.Key, command))
+	cmd := exec.Command("sh", "-c", command)
+	cmd.Env = append(os.Environ(), g.environ()...)
+	cmd.Stdin = bytes.NewReader(append(payload, '\n'))
+	output, err := cmd.CombinedOutput()
+	if err != nil {
+		Log("error", fmt.Sprintf("Dispatcher failed for %s: %v\nOutput: %s", g.Key, err, strings.TrimSpace(string(output))))
+		return false
+	}
+	Log("debug", fmt.Sprintf("Dispatcher output: %s", strings.TrimSpace(string(output))))
+	return true
+}
+
+var (
+	// lastExecutedAt, lastExecutedCount, lastExecutedKey and
+	// lastExecutedDevice describe the most recent gesture whose action was
+	// executed.
+	lastExecutedAt     time.Time
+	lastExecutedCount  int
+	lastExecutedKey    string
+	lastExecutedDevice string
+	// splitting is set while completeGesture dispatches the groups of a
+	// split touch, and splitExecuted once one of them was executed: the
+	// other groups finished at the same time and are neither its residual
+	// lift-off nor within its settle time.
+	splitting, splitExecuted bool
+)
+
+// noteExecuted records g as the most recent executed gesture.
+func noteExecuted(g Gesture) {
+	lastExecutedAt, lastExecutedCount = time.Now(), g.Count
+	lastExecutedKey, lastExecutedDevice = g.Key, currentDevice
+	if splitting {
+		splitExecuted = true
+	}
+}
+
+// sameDeviceAsExecuted reports whether the gesture in progress comes from
+// the device of the last executed gesture, or MultiDeviceMode makes devices
+// interchangeable.
+func sameDeviceAsExecuted() bool {
+	return config.MultiDeviceMode == "coalesce" || currentDevice == lastExecutedDevice
+}
+
+// defaultConfirmWindow is used when an action with RequireConfirm has no
+// ConfirmWindowMs.
+const defaultConfirmWindow = 2 * time.Second
+
+var (
+	// armedKey is the gesture waiting for confirmation, if any, and armedAt
+	// when it was armed.
+	armedKey string
+	armedAt  time.Time
+)
+
+// confirmGesture reports whether g confirms its previously armed action. If
+// it does not, g's action is armed instead and ConfirmCommand is run.
+func confirmGesture(g Gesture, action Action) bool {
+	window := defaultConfirmWindow
+	if action.ConfirmWindowMs > 0 {
+		window = time.Duration(action.ConfirmWindowMs) * time.Millisecond
+	}
+	if armedKey == g.Key && time.Since(armedAt) <= window {
+		armedKey = ""
+		Log("info", fmt.Sprintf("Gesture %s confirmed", g.Key))
+		return true
+	}
+	armedKey, armedAt = g.Key, time.Now()
+	Log("info", fmt.Sprintf("Gesture %s armed, repeat within %dms to confirm", g.Key, window.Milliseconds()))
+	if action.ConfirmCommand != "" {
+		commandsWG.Add(1)
+		go func() {
+			defer commandsWG.Done()
+			if err := runCommand(action.ConfirmCommand, 0, Action{}, g); err != nil {
+				Log("error", fmt.Sprintf("Error executing confirm command: %v", err))
+			}
+		}()
+	}
+	return false
+}
+
+// lastFiredAt records when the action of each gesture key with a
+// MinIntervalMs was last started. Gestures dropped before their action
+// started do not restart the interval.
+var lastFiredAt = make(map[string]time.Time)
+
+var (
+	// busyMu guards busyCommands and busyUntil, which are updated by the
+	// command goroutines.
+	busyMu sync.Mutex
+	// busyCommands counts the running commands of each gesture key with a
+	// BusyGraceMs, and busyUntil is when its grace period ends.
+	busyCommands = make(map[string]int)
+	busyUntil    = make(map[string]time.Time)
+)
+
+// markBusy records that a command for the gesture key started.
+func markBusy(key string) {
+	busyMu.Lock()
+	defer busyMu.Unlock()
+	busyCommands[key]++
+}
+
+// markIdle records that a command for the gesture key exited, starting its
+// grace period.
+func markIdle(key string, grace time.Duration) {
+	busyMu.Lock()
+	defer busyMu.Unlock()
+	if busyCommands[key]--; busyCommands[key] <= 0 {
+		delete(busyCommands, key)
+	}
+	busyUntil[key] = time.Now().Add(grace)
+}
+
+// commandBusy reports whether a command for the gesture key is running and
+// otherwise how much of its grace period remains.
+func commandBusy(key string) (bool, time.Duration) {
+	busyMu.Lock()
+	defer busyMu.Unlock()
+	if busyCommands[key] > 0 {
+		return true, 0
+	}
+	return false, time.Until(busyUntil[key])
+}
+
+// isResidual reports whether g follows an executed gesture so closely, and
+// with a finger count matching ResidualFingerRule, that it is most likely
+// fingers lifting off from that gesture.
+func isResidual(g Gesture) bool {
+	if config.ResidualSuppressMs <= 0 || !sameDeviceAsExecuted() ||
+		time.Since(lastExecutedAt) > time.Duration(config.ResidualSuppressMs)*time.Millisecond {
+		return false
+	}
+	switch config.ResidualFingerRule {
+	case "any":
+		return true
+	case "fewerOrEqual":
+		return g.Count <= lastExecutedCount
+	default:
+		return g.Count < lastExecutedCount
+	}
+}
+
+// inhibitReason returns why the action for the gesture key is currently
+// inhibited, or "" if it may run.
+func inhibitReason(key string) string {
+	if executionDisabled.Load() {
+		return "disabled through the control API"
+	}
+	if config.InhibitWhenLocked && !slices.Contains(config.AllowWhenLocked, key) && screenLocked() {
+		return "screen is locked"
+	}
+	if !inSchedule(time.Now()) {
+		return "outside the schedule"
+	}
+	if name := inhibitingProcess(); name != "" {
+		return name + " is running"
+	}
+	if since := time.Since(lastKeyPress); config.DisableWhileTypingMs > 0 &&
+		since < time.Duration(config.DisableWhileTypingMs)*time.Millisecond {
+		return fmt.Sprintf("keyboard activity %dms ago", since.Milliseconds())
+	}
+	return ""
+}
+
+// weekdayNames are the Schedule day names, indexed by time.Weekday.
+var weekdayNames = []string{"sun", "mon", "tue", "wed", "thu", "fri", "sat"}
+
+// validateScheduleWindow logs the problems of a Schedule window. Invalid
+// windows never match.
+func validateScheduleWindow(window ScheduleWindow) {
+	for _, clock := range []string{window.Start, window.End} {
+		if _, err := parseClock(clock); err != nil {
+			Log("error", fmt.Sprintf("Invalid schedule time %q (must be HH:MM), ignoring window", clock))
+			return
+		}
+	}
+	for _, day := range window.Days {
+		if !slices.Contains(weekdayNames, strings.ToLower(day)) {
+			Log("error", fmt.Sprintf("Invalid schedule day %q (must be mon, tue, wed, thu, fri, sat or sun)", day))
+		}
+	}
+}
+
+// inSchedule reports whether now falls into a Schedule window. Without a
+// schedule every time does.
+func inSchedule(now time.Time) bool {
+	if len(config.Schedule) == 0 {
+		return true
+	}
+	minute := now.Hour()*60 + now.Minute()
+	today := now.Weekday()
+	yesterday := (today + 6) % 7
+	for _, window := range config.Schedule {
+		start, err := parseClock(window.Start)
+		if err != nil {
+			continue
+		}
+		end, err := parseClock(window.End)
+		if err != nil {
+			continue
+		}
+		if start < end {
+			if window.onDay(today) && minute >= start && minute < end {
+				return true
+			}
+			continue
+		}
+		if window.onDay(today) && minute >= start || window.onDay(yesterday) && minute < end {
+			return true
+		}
+	}
+	return false
+}
+
+// onDay reports whether the window starts on day.
+func (w ScheduleWindow) onDay(day time.Weekday) bool {
+	if len(w.Days) == 0 {
+		return true
+	}
+	return slices.ContainsFunc(w.Days, func(d string) bool {
+		return strings.ToLower(d) == weekdayNames[day]
+	})
+}
+
+// parseClock parses "HH:MM" into minutes since midnight.
+func parseClock(clock string) (int, error) {
+	if clock == "24:00" {
+		return 24 * 60, nil
+	}
+	t, err := time.Parse("15:04", clock)
+	if err != nil {
+		return 0, err
+	}
+	return t.Hour()*60 + t.Minute(), nil
+}
+
+// gestureLogMu serializes writes to the GestureLogCSV file, which dispatcher
+// goroutines append to as well.
+var gestureLogMu sync.Mutex
+
+// logGestureCSV appends g to the GestureLogCSV file, writing a header row
+// when the file is new. The file is reopened for every gesture so that it can
+// be rotated externally.
+func logGestureCSV(g Gesture, executed bool) {
+	path := liveConfig().GestureLogCSV
+	if path == "" {
+		return
+	}
+	gestureLogMu.Lock()
+	defer gestureLogMu.Unlock()
+	file, err := os.OpenFile(path, os.O_APPEND|os.O_CREATE|os.O_WRONLY, 0644)
+	if err != nil {
+		Log("error", fmt.Sprintf("Error opening gesture log %s: %v", path, err))
+		return
+	}
+	defer file.Close()
+	writer := csv.NewWriter(file)
+	if info, err := file.Stat(); err == nil && info.Size() == 0 {
+		writer.Write([]string{"timestamp", "gesture_key", "fingers", "dx", "dy", "executed"})
+	}
+	writer.Write([]string{
+		time.Now().Format(time.RFC3339),
+		g.Key,
+		strconv.Itoa(g.Count),
+		formatFloat(g.Dx),
+		formatFloat(g.Dy),
+		strconv.FormatBool(executed),
+	})
+	writer.Flush()
+	if err := writer.Error(); err != nil {
+		Log("error", fmt.Sprintf("Error writing gesture log %s: %v", path, err))
+	}
+}
+
+// maxRawLines bounds the number of raw lines buffered for one gesture.
+const maxRawLines = 10000
+
+// rawLines buffers the debug-events lines of the gesture in progress when
+// RawLinesPath is set.
+var rawLines []string
+
+// recordRawLine buffers line for the gesture in progress.
+func recordRawLine(line string) {
+	if config.RawLinesPath != "" && len(rawLines) < maxRawLines {
+		rawLines = append(rawLines, line)
+	}
+}
+
+// takeRawLines returns the buffered raw lines and starts a new buffer.
+func takeRawLines() []string {
+	lines := rawLines
+	rawLines = nil
+	return lines
+}
+
+// writeRawLines appends g to the RawLinesPath file as a
+// "RAW <key> <lines>" header line followed by the raw lines it was detected
+// from. Like the gesture log, the file is reopened for every gesture.
+func writeRawLines(g Gesture) {
+	var b strings.Builder
+	fmt.Fprintf(&b, "RAW %s %d\n", g.Key, len(g.rawLines))
+	for _, line := range g.rawLines {
+		b.WriteString(line)
+		b.WriteByte('\n')
+	}
+	if config.RawLinesPath == "-" {
+		fmt.Fprint(os.Stdout, b.String())
+		return
+	}
+	file, err := os.OpenFile(config.RawLinesPath, os.O_APPEND|os.O_CREATE|os.O_WRONLY, 0644)
+	if err != nil {
+		Log("error", fmt.Sprintf("Error opening raw lines file %s: %v", config.RawLinesPath, err))
+		return
+	}
+	defer file.Close()
+	if _, err := file.WriteString(b.String()); err != nil {
+		Log("error", fmt.Sprintf("Error writing raw lines file %s: %v", config.RawLinesPath, err))
+	}
+}
+
+// emitOnly is set by -emit: every detected gesture is printed with
+// emitGesture and no actions run.
+var emitOnly bool
+
+// emitGesture writes g to stdout as a single line in EmitFormat.
+func emitGesture(g Gesture) {
+	if config.EmitFormat == "event" {
+		fmt.Fprintln(os.Stdout, eventLine(g))
+		return
+	}
+	fmt.Fprintf(os.Stdout, "%s %d %s %s\n", g.Key, g.Count, formatFloat(g.Dx), formatFloat(g.Dy))
+}
+
+// eventLineVersion is the version of the "event" emit format. Bump it when
+// the positional fields change; new key=value fields may be appended
+// without a bump.
+const eventLineVersion = 1
+
+// eventLine formats g in the libinput-like "event" emit format:
+//
+//	GESTURE/1 <type> <dir> <count> +<seconds>s dx=<dx> dy=<dy> key=<key> [name=value...]
+//
+// where <seconds> is the time since ffgestures started and <dir> is "-" for
+// gestures without a direction.
+func eventLine(g Gesture) string {
+	direction := cmp.Or(g.Direction, "-")
+	line := fmt.Sprintf("GESTURE/%d %s %s %d +%.3fs dx=%s dy=%s key=%s", eventLineVersion, g.Type, direction, g.Count,
+		time.Since(startedAt).Seconds(), formatFloat(g.Dx), formatFloat(g.Dy), g.Key)
+	if g.Scale != 0 || g.Angle != 0 {
+		line += fmt.Sprintf(" scale=%s angle=%s", formatFloat(g.Scale), formatFloat(g.Angle))
+	}
+	if g.Pressure != 0 {
+		line += " pressure=" + formatFloat(g.Pressure)
+	}
+	return line
+}
+
+// weightedTravel averages the fingers' travel from touch-down to lift
+// weighted by its length, so the fingers that moved furthest decide the
+// direction. It returns false when no finger moved.
+func weightedTravel(touches []*TouchPoint) (float64, float64, bool) {
+	var dx, dy, total float64
+	for _, tp := range touches {
+		x, y := tp.lastX-tp.startX, tp.lastY-tp.startY
+		length := math.Hypot(x, y)
+		dx += x * length
+		dy += y * length
+		total += length
+	}
+	if total == 0 {
+		return 0, 0, false
+	}
+	return dx / total, dy / total, true
+}
+
+// averagePathLength returns the average distance touches travelled along
+// their paths.
+func averagePathLength(touches []*TouchPoint) float64 {
+	var total float64
+	for _, tp := range touches {
+		total += tp.pathLength
+	}
+	return total / float64(len(touches))
+}
+
+// tooFewSamples reports, and logs, whether touches produced fewer motion
+// samples than MinSamples or MinMotionEvents require.
+func tooFewSamples(touches []*TouchPoint) bool {
+	if samples := mostSamples(touches); samples < config.MinSamples {
+		Log("debug", fmt.Sprintf("Gesture had only %d motion sample(s), fewer than minSamples, gesture ignored", samples))
+		return true
+	}
+	if samples := fewestSamples(touches); samples < config.MinMotionEvents {
+		Log("debug", fmt.Sprintf("A finger had only %d motion sample(s), fewer than minMotionEvents, gesture ignored", samples))
+		return true
+	}
+	return false
+}
+
+// mostSamples returns the most TOUCH_MOTION updates any of touches produced.
+func mostSamples(touches []*TouchPoint) int {
+	samples := 0
+	for _, tp := range touches {
+		samples = max(samples, tp.samples)
+	}
+	return samples
+}
+
+// fewestSamples returns the fewest TOUCH_MOTION updates any of touches
+// produced.
+func fewestSamples(touches []*TouchPoint) int {
+	samples := math.MaxInt
+	for _, tp := range touches {
+		samples = min(samples, tp.samples)
+	}
+	return samples
+}
+
+// touchLifetime returns the time from the first finger landing to the last
+// one lifting. Unlike gestureDuration it includes time the fingers rested
+// without moving before lifting.
+func touchLifetime(touches []*TouchPoint) float64 {
+	if len(touches) == 0 {
+		return 0
+	}
+	start, end := touches[0].startTime, touches[0].liftTime
+	for _, tp := range touches[1:] {
+		start = math.Min(start, tp.startTime)
+		end = math.Max(end, tp.liftTime)
+	}
+	return end - start
+}
+
+// gestureDuration returns the time in seconds from the first finger's first
+// motion to the last finger's last motion.
+func gestureDuration(touches []*TouchPoint) float64 {
+	if len(touches) == 0 {
+		return 0
+	}
+	start, end := touches[0].startTime, touches[0].lastTime
+	for _, tp := range touches[1:] {
+		start = math.Min(start, tp.startTime)
+		end = math.Max(end, tp.lastTime)
+	}
+	return end - start
+}
+
+// thresholdFor returns the movement threshold for a gesture with the given
+// number of fingers, falling back to the global Threshold.
+func thresholdFor(count int) float64 {
+	if device, ok := currentDeviceConfig(); ok {
+		if t, ok := device.ThresholdByFingerCount[count]; ok {
+			return t
+		}
+		if device.Threshold > 0 {
+			return device.Threshold
+		}
+	}
+	if t, ok := config.ThresholdByFingerCount[count]; ok {
+		return t
+	}
+	if config.AdaptiveThreshold && len(recentTravel) >= minAdaptiveSamples {
+		return adaptiveThreshold
+	}
+	return config.Threshold
+}
+
+// minAdaptiveSamples is how many swipes AdaptiveThreshold needs before it
+// replaces Threshold.
+const minAdaptiveSamples = 5
+
+var (
+	// recentTravel holds the travel of the most recent recognized
+	// touchscreen swipes, oldest first.
+	recentTravel []float64
+	// adaptiveThreshold is the threshold derived from recentTravel.
+	adaptiveThreshold float64
+)
+
+// recordTravel adds the travel of a recognized swipe to recentTravel and
+// recomputes adaptiveThreshold.
+func recordTravel(travel float64) {
+	recentTravel = append(recentTravel, travel)
+	if excess := len(recentTravel) - max(config.AdaptiveThresholdWindow, minAdaptiveSamples); excess > 0 {
+		recentTravel = recentTravel[excess:]
+	}
+	var sum float64
+	for _, t := range recentTravel {
+		sum += t
+	}
+	threshold := config.AdaptiveThresholdRatio * sum / float64(len(recentTravel))
+	threshold = min(max(threshold, config.AdaptiveThresholdMin), config.AdaptiveThresholdMax)
+	if len(recentTravel) < minAdaptiveSamples || threshold == adaptiveThreshold {
+		return
+	}
+	Log("debug", fmt.Sprintf("Adaptive threshold now %s", formatFloat(threshold)))
+	adaptiveThreshold = threshold
+}
+
+// currentDeviceConfig returns the Devices block for the device that produced
+// the gesture in progress, matched by event node or device name.
+func currentDeviceConfig() (DeviceConfig, bool) {
+	if device, ok := config.Devices[currentDevice]; ok {
+		return device, true
+	}
+	if info, ok := devices[currentDevice]; ok {
+		device, ok := config.Devices[info.name]
+		return device, ok
+	}
+	return DeviceConfig{}, false
+}
+
+// ------------------ Actions ------------------
+
+var (
+	// activeLayer is the name of the active binding layer ("" for the base
+	// GestureActions).
+	activeLayer string
+	// layerLastUsed is when the active layer was entered or last matched a
+	// gesture, used for layerTimeout.
+	layerLastUsed time.Time
+	// layerTimer returns to the base bindings once layerTimeout passed
+	// since layerLastUsed.
+	layerTimer *time.Timer
+	// layerTimeout is LayerTimeoutMs, or the timeout of the "pushLayer"
+	// action that activated the layer.
+	layerTimeout time.Duration
+	// layerPushed is set while the active layer was pushed for the next
+	// gesture, which returns to pushedFrom.
+	layerPushed bool
+	pushedFrom  string
+)
+
+// lookupAction resolves key against the active layer, falling back to the
+// base GestureActions. An expired layer is deactivated first.
+func lookupAction(key string) (Action, bool) {
+	if activeLayer != "" && layerTimeout > 0 && time.Since(layerLastUsed) > layerTimeout {
+		expireLayer()
+	}
+	if activeLayer != "" {
+		layerLastUsed = time.Now()
+		if action, ok := config.Layers[activeLayer][key]; ok {
+			return action, true
+		}
+	}
+	if device, ok := currentDeviceConfig(); ok {
+		if action, ok := device.GestureActions[key]; ok {
+			return action, true
+		}
+	}
+	action, ok := config.GestureActions[key]
+	return action, ok
+}
+
+// commandsWG tracks running commands so that one-shot modes can wait for them.
+var commandsWG sync.WaitGroup
+
+// runAction performs action for gesture g and reports whether it ran. Built-in
+// actions are applied immediately; shell commands run in their own goroutine
+// unless Async is false. Unknown action types, layers, modes and log levels
+// are logged and not run.
+func runAction(action Action, g Gesture) bool {
+	switch action.Type {
+	case "", "shell":
+		if len(action.Toggle) > 0 {
+			i := toggleIndex[g.Key] % len(action.Toggle)
+			action.Command = action.Toggle[i]
+			toggleIndex[g.Key] = (i + 1) % len(action.Toggle)
+			saveState()
+		}
+		if action.BusyGraceMs > 0 {
+			markBusy(g.Key)
+		}
+		run := func() {
+			executeCommand(action, g)
+			if action.BusyGraceMs > 0 {
+				markIdle(g.Key, time.Duration(action.BusyGraceMs)*time.Millisecond)
+			}
+		}
+		if action.Async != nil && !*action.Async {
+			run()
+			return true
+		}
+		commandsWG.Add(1)
+		go func() {
+			defer commandsWG.Done()
+			run()
+		}()
+	case "switchLayer":
+		return switchLayer(action.Layer)
+	case "pushLayer":
+		return pushLayer(action.Layer, time.Duration(action.LayerTimeoutMs)*time.Millisecond)
+	case "setMode":
+		return setMode(action.Mode)
+	case "setLogLevel":
+		return setLogLevel(action.Level)
+	case "fifo":
+		writeFifo(action.Fifo, expandTemplate(cmp.Or(action.Message, "{key}"), g.fields()))
+	case "reloadConfig":
+		// Gestures are dispatched with eventMu held, which reload takes
+		// once the configuration is fetched.
+		commandsWG.Add(1)
+		go func() {
+			defer commandsWG.Done()
+			reload()
+		}()
+	default:
+		Log("error", fmt.Sprintf("Unknown action type %q for gesture %s", action.Type, g.Key))
+		return false
+	}
+	return true
+}
+
+// switchLayer activates the named layer, or the base bindings when name is "",
+// and reports whether the layer exists.
+func switchLayer(name string) bool {
+	if _, ok := config.Layers[name]; name != "" && !ok {
+		Log("error", fmt.Sprintf("Cannot switch to unknown layer %s", name))
+		return false
+	}
+	if name == "" {
+		Log("info", "Switched to base layer")
+	} else {
+		Log("info", fmt.Sprintf("Switched to layer %s", name))
+	}
+	setLayer(name, time.Duration(config.LayerTimeoutMs)*time.Millisecond)
+	return true
+}
+
+// pushLayer activates the named layer for the next gesture, after which
+// popLayer returns to the current one. The layer expires after timeout, or
+// LayerTimeoutMs if timeout is 0. It reports whether the layer exists.
+func pushLayer(name string, timeout time.Duration) bool {
+	if _, ok := config.Layers[name]; !ok {
+		Log("error", fmt.Sprintf("Cannot push unknown layer %s", name))
+		return false
+	}
+	Log("info", fmt.Sprintf("Pushed layer %s for the next gesture", name))
+	from := activeLayer
+	setLayer(name, cmp.Or(timeout, time.Duration(config.LayerTimeoutMs)*time.Millisecond))
+	layerPushed, pushedFrom = true, from
+	return true
+}
+
+// popLayer returns from a pushed layer to the layer active before it.
+func popLayer() {
+	if pushedFrom == "" {
+		Log("info", fmt.Sprintf("Popped layer %s, returning to base layer", activeLayer))
+	} else {
+		Log("info", fmt.Sprintf("Popped layer %s, returning to layer %s", activeLayer, pushedFrom))
+	}
+	setLayer(pushedFrom, time.Duration(config.LayerTimeoutMs)*time.Millisecond)
+}
+
+// expireLayer leaves the active layer once its timeout passed: a pushed
+// layer returns to the layer it was pushed from, others to the base
+// bindings.
+func expireLayer() {
+	if layerPushed {
+		Log("info", fmt.Sprintf("Layer %s timed out", activeLayer))
+		popLayer()
+		return
+	}
+	Log("info", fmt.Sprintf("Layer %s timed out, returning to base layer", activeLayer))
+	setLayer("", 0)
+}
+
+// setLayer makes name the active layer, arms timeout and runs LayerCommand
+// if the layer changed.
+func setLayer(name string, timeout time.Duration) {
+	changed := name != activeLayer
+	activeLayer = name
+	layerLastUsed = time.Now()
+	layerTimeout = timeout
+	layerPushed, pushedFrom = false, ""
+	if layerTimer != nil {
+		layerTimer.Stop()
+		layerTimer = nil
+	}
+	if name != "" && timeout > 0 {
+		armLayerTimeout(timeout)
+	}
+	if changed && config.LayerCommand != "" {
+		command := expandTemplate(config.LayerCommand, map[string]string{"layer": name})
+		commandsWG.Add(1)
+		go func() {
+			defer commandsWG.Done()
+			if err := runCommand(command, 0, Action{}, Gesture{}); err != nil {
+				Log("error", fmt.Sprintf("Error executing layer command: %v", err))
+			}
+		}()
+	}
+}
+
+// armLayerTimeout checks after delay whether the active layer expired, and
+// rearms itself for the remaining time if a gesture used the layer since.
+func armLayerTimeout(delay time.Duration) {
+	var timer *time.Timer
+	timer = time.AfterFunc(delay, func() {
+		eventMu.Lock()
+		defer eventMu.Unlock()
+		if layerTimer != timer {
+			return
+		}
+		layerTimer = nil
+		if remaining := layerTimeout - time.Since(layerLastUsed); remaining > 0 {
+			armLayerTimeout(remaining)
+			return
+		}
+		expireLayer()
+	})
+	layerTimer = timer
+}
+
+// toggleIndex holds the index of the next command of each toggle action, by
+// gesture key. It is persisted in StateFile.
+var toggleIndex = make(map[string]int)
+
+// fifoFDs holds the write ends of the named pipes used by "fifo" actions,
+// opened on first use and kept open.
+var fifoFDs = make(map[string]int)
+
+// writeFifo writes message as a line to the named pipe at path. The pipe is
+// opened non-blocking, so the message is dropped rather than stalling the
+// event loop when no reader is present or the pipe is full; a pipe whose
+// reader went away is reopened on the next write.
+func writeFifo(path, message string) {
+	fd, ok := fifoFDs[path]
+	if !ok {
+		var err error
+		fd, err = syscall.Open(path, syscall.O_WRONLY|syscall.O_NONBLOCK|syscall.O_CLOEXEC, 0)
+		if err != nil {
+			if err == syscall.ENXIO {
+				Log("warn", fmt.Sprintf("No reader on %s, dropping %q", path, message))
+			} else {
+				Log("error", fmt.Sprintf("Error opening %s: %v", path, err))
+			}
+			return
+		}
+		fifoFDs[path] = fd
+	}
+	if _, err := syscall.Write(fd, []byte(message+"\n")); err != nil {
+		if err == syscall.EAGAIN {
+			Log("warn", fmt.Sprintf("%s is full, dropping %q", path, message))
+			return
+		}
+		Log("warn", fmt.Sprintf("Error writing to %s, will reopen: %v", path, err))
+		syscall.Close(fd)
+		delete(fifoFDs, path)
+		return
+	}
+	Log("debug", fmt.Sprintf("Wrote %q to %s", message, path))
+}
+
+// setLogLevel changes the log level at runtime, or returns to the configured
+// level when level is "", and reports whether the level is known.
+func setLogLevel(level string) bool {
+	if level != "" && !slices.Contains(logLevels, level) {
+		Log("error", fmt.Sprintf("Cannot set unknown log level %s", level))
+		return false
+	}
+	logLevelOverride.Store(level)
+	if level == "" {
+		Log("info", fmt.Sprintf("Log level reset to %s", currentLogLevel()))
+	} else {
+		Log("info", fmt.Sprintf("Log level set to %s", level))
+	}
+	return true
+}
+
+// ------------------ Modes ------------------
+
+// activeMode is the current mode ("" when no mode is active). It is persisted
+// to the state file.
+var activeMode string
+
+// setMode activates the named mode, or clears it if it is already active or
+// name is "". The result is persisted to the state file. It reports whether
+// the mode exists.
+func setMode(name string) bool {
+	if _, ok := config.Modes[name]; name != "" && !ok {
+		Log("error", fmt.Sprintf("Cannot set unknown mode %s", name))
+		return false
+	}
+	if name == activeMode {
+		name = ""
+	}
+	activeMode = name
+	if name == "" {
+		Log("info", "Mode cleared, all gestures enabled")
+	} else {
+		Log("info", fmt.Sprintf("Mode %s active", name))
+	}
+	saveState()
+	return true
+}
+
+// modeAllows reports whether the gesture bound to action may run in the
+// active mode. Mode switches themselves are always allowed.
+func modeAllows(key string, action Action) bool {
+	if activeMode == "" || action.Type == "setMode" {
+		return true
+	}
+	return slices.Contains(config.Modes[activeMode], key)
+}
+
+// ------------------ State File ------------------
+
+// persistentState is the runtime state saved to StateFile across restarts.
+type persistentState struct {
+	Mode string `json:"mode"`
+	// Toggles holds the index of the next command of each toggle action, by
+	// gesture key.
+	Toggles map[string]int `json:"toggles,omitempty"`
+}
+
+// loadState restores runtime state from StateFile, if configured.
+func loadState() {
+	if config.StateFile == "" {
+		return
+	}
+	data, err := os.ReadFile(config.StateFile)
+	if err != nil {
+		if !os.IsNotExist(err) {
+			Log("warn", fmt.Sprintf("Could not read state file %s: %v", config.StateFile, err))
+		}
+		return
+	}
+	var state persistentState
+	if err := json.Unmarshal(data, &state); err != nil {
+		Log("warn", fmt.Sprintf("Could not decode state file %s: %v", config.StateFile, err))
+		return
+	}
+	if _, ok := config.Modes[state.Mode]; state.Mode != "" && ok {
+		activeMode = state.Mode
+		Log("info", fmt.Sprintf("Restored mode %s", activeMode))
+	}
+	if state.Toggles != nil {
+		toggleIndex = state.Toggles
+	}
+}
+
+// saveState writes runtime state to StateFile, if configured. The file is
+// replaced atomically.
+func saveState() {
+	if config.StateFile == "" {
+		return
+	}
+	data, err := json.Marshal(persistentState{Mode: activeMode, Toggles: toggleIndex})
+	if err != nil {
+		Log("error", fmt.Sprintf("Error encoding state: %v", err))
+		return
+	}
+	tmp := config.StateFile + ".tmp"
+	if err := os.WriteFile(tmp, data, 0644); err != nil {
+		Log("error", fmt.Sprintf("Error writing state file %s: %v", tmp, err))
+		return
+	}
+	if err := os.Rename(tmp, config.StateFile); err != nil {
+		Log("error", fmt.Sprintf("Error replacing state file %s: %v", config.StateFile, err))
+	}
+}
+
+// ------------------ Simulation ------------------
+
+// simulateFrames is the number of motion frames synthesized by simulateGesture.
+const simulateFrames = 10
+
+// simulateGesture synthesizes touches for the swipe with the given key and
+// feeds them through the same frame and gesture processing as real input.
+// The key is matched against every finger count and direction using the
+// configured KeyFormat.
+func simulateGesture(key string) error {
+	for count := 1; count <= 10; count++ {
+		for _, direction := range []string{"left", "right", "up", "down"} {
+			if gestureKey(Gesture{Type: "swipe", Count: count, Direction: direction}) != key {
+				continue
+			}
+			Log("info", fmt.Sprintf("Simulating %d-finger swipe %s", count, direction))
+			// Travel well past the threshold while staying on the panel.
+			travel := math.Min(thresholdFor(count)*3, 60)
+			var dx, dy float64
+			switch direction {
+			case "left":
+				dx = -travel
+			case "right":
+				dx = travel
+			case "up":
+				dy = -travel
+			case "down":
+				dy = travel
+			}
+			for frame := 0; frame <= simulateFrames; frame++ {
+				progress := float64(frame) / simulateFrames
+				eventTime := float64(frame) * 0.01
+				for finger := 0; finger < count; finger++ {
+					x := 50 - dx/2 + float64(finger-count/2)*3 + dx*progress
+					y := 50 - dy/2 + dy*progress
+					updateTouch(finger, x, y, eventTime)
+				}
+				processFrame(eventTime)
+			}
+			// An empty frame lifts all fingers and completes the gesture.
+			processFrame(float64(simulateFrames+1) * 0.01)
+			flushCompletion()
+			return nil
+		}
+	}
+	return fmt.Errorf("cannot simulate %q: not a swipe key for 1-10 fingers with keyFormat %q", key, config.KeyFormat)
+}
+
+// ------------------ Action Verification ------------------
+
+// verifyTimeout bounds each command run by verifyActions.
+const verifyTimeout = 10 * time.Second
+
+// verifyActions runs the shell commands of every action with Verify once
+// with FFGESTURE_VERIFY=1 in its environment, so that scripts can validate
+// their setup without acting, and prints which commands exited non-zero.
+// The commands of other actions, DispatcherCommand and LayerCommand are
+// listed as skipped. It returns the number of failures.
+func verifyActions() (failed int) {
+	commands := make(map[string]string)
+	var skipped []string
+	addAction := func(name string, action Action) {
+		if action.Type != "" && action.Type != "shell" {
+			return
+		}
+		found := make(map[string]string)
+		if action.Command != "" {
+			found[name] = action.Command
+		}
+		for i, command := range action.Toggle {
+			found[fmt.Sprintf("%s[toggle %d]", name, i+1)] = command
+		}
+		for i, step := range action.Commands {
+			if (step.Type == "" || step.Type == "shell") && step.Command != "" {
+				found[fmt.Sprintf("%s[step %d]", name, i+1)] = step.Command
+			}
+		}
+		if action.ConfirmCommand != "" {
+			found[name+"[confirm]"] = action.ConfirmCommand
+		}
+		if action.Verify {
+			maps.Copy(commands, found)
+		} else {
+			skipped = slices.AppendSeq(skipped, maps.Keys(found))
+		}
+	}
+	for key, action := range config.GestureActions {
+		addAction(key, action)
+	}
+	for layer, actions := range config.Layers {
+		for key, action := range actions {
+			addAction(layer+"/"+key, action)
+		}
+	}
+	for device, block := range config.Devices {
+		for key, action := range block.GestureActions {
+			addAction(device+"/"+key, action)
+		}
+	}
+	if config.DispatcherCommand != "" {
+		skipped = append(skipped, "dispatcherCommand")
+	}
+	if config.LayerCommand != "" {
+		skipped = append(skipped, "layerCommand")
+	}
+
+	slices.Sort(skipped)
+	for _, name := range skipped {
+		fmt.Printf("skip %s\n", name)
+	}
+	names := slices.Sorted(maps.Keys(commands))
+	for _, name := range names {
+		key := name[strings.LastIndex(name, "/")+1:]
+		key, _, _ = strings.Cut(key, "[")
+		g := Gesture{Key: key}
+		command := expandTemplate(commands[name], g.fields())
+		ctx, cancel := context.WithTimeout(context.Background(), verifyTimeout)
+		cmd := exec.CommandContext(ctx, "sh", "-c", command)
+		cmd.Env = append(append(os.Environ(), g.environ()...), "FFGESTURE_VERIFY=1")
+		output, err := cmd.CombinedOutput()
+		cancel()
+		if err != nil {
+			fmt.Printf("FAIL %s: %s: %v\n", name, command, err)
+			if out := strings.TrimSpace(string(output)); out != "" {
+				fmt.Printf("    %s\n", strings.ReplaceAll(out, "\n", "\n    "))
+			}
+			failed++
+			continue
+		}
+		fmt.Printf("ok   %s\n", name)
+	}
+	fmt.Printf("%d commands verified, %d failed, %d skipped\n", len(names), failed, len(skipped))
+	return failed
+}
+
+// ------------------ Replay ------------------
+
+// replayExpectedSuffix is appended to a capture's file name to form the
+// sidecar file listing the gesture keys it must produce, one per line.
+const replayExpectedSuffix = ".expected"
+
+// replayExecutedSuffix is appended to a capture's file name to form an
+// optional sidecar listing the gestures whose actions would run. Such
+// captures are replayed a second time through the checks that can drop a
+// gesture before its action runs, such as postGestureSettleMs.
+const replayExecutedSuffix = ".executed"
+
+// replayConfigSuffix is appended to a capture's file name to form the name of
+// an optional JSON file with settings applied on top of the configuration
+// while replaying it.
+const replayConfigSuffix = ".json"
+
+// replayedKeys collects the gesture keys detected while replaying. When it is
+// non-nil, dispatchGesture records gestures here instead of acting on them:
+// as soon as they are detected, or, while replayGated is set, in place of
+// running their actions.
+var (
+	replayedKeys *[]string
+	replayGated  bool
+)
+
+// deviceAddedRegex matches the DEVICE_ADDED lines at the start of a
+// debug-events capture and extracts the device node and capability letters.
+var deviceAddedRegex = regexp.MustCompile(`^\s*-?(\S+)\s+DEVICE_ADDED\s.*\scap:(\S+)`)
+
+// deviceCapabilities maps debug-events capability letters to the names used
+// by "libinput list-devices".
+var deviceCapabilities = map[rune]string{
+	'k': "keyboard",
+	'p': "pointer",
+	't': "touch",
+	'T': "tablet",
+	'P': "tablet-pad",
+	'g': "gesture",
+	'S': "switch",
+}
+
+// replayCheck compares the gestures of a replayed capture against the keys
+// listed in one of its sidecars.
+type replayCheck struct {
+	name     string
+	expected []string
+	gated    bool
+}
+
+// runReplay replays every capture in dir that has an expected-keys sidecar,
+// comparing the gestures it produces against the sidecar, and against its
+// executed sidecar if it has one, and printing a diff for each mismatch. It
+// returns the number of passed and failed checks.
+func runReplay(dir string) (passed, failed int, err error) {
+	entries, err := os.ReadDir(dir)
+	if err != nil {
+		return 0, 0, err
+	}
+	for _, entry := range entries {
+		name := entry.Name()
+		if entry.IsDir() || strings.HasSuffix(name, replayExpectedSuffix) || strings.HasSuffix(name, replayExecutedSuffix) ||
+			strings.HasSuffix(name, replayConfigSuffix) {
+			continue
+		}
+		path := filepath.Join(dir, name)
+		expectedData, err := os.ReadFile(path + replayExpectedSuffix)
+		if err != nil {
+			Log("warn", fmt.Sprintf("Skipping %s: %v", name, err))
+			continue
+		}
+		checks := []replayCheck{{name, strings.Fields(string(expectedData)), false}}
+		if executedData, err := os.ReadFile(path + replayExecutedSuffix); err == nil {
+			checks = append(checks, replayCheck{name + replayExecutedSuffix, strings.Fields(string(executedData)), true})
+		}
+		for _, check := range checks {
+			saved := config
+			if err := applyReplayConfig(path); err != nil {
+				return passed, failed, err
+			}
+			publishConfig()
+			replayGated = check.gated
+			got, err := replayCapture(path)
+			replayGated = false
+			config = saved
+			publishConfig()
+			if err != nil {
+				return passed, failed, err
+			}
+			if slices.Equal(check.expected, got) {
+				fmt.Printf("PASS %s\n", check.name)
+				passed++
+				continue
+			}
+			fmt.Printf("FAIL %s\n", check.name)
+			for _, line := range diffLines(check.expected, got) {
+				fmt.Printf("    %s\n", line)
+			}
+			failed++
+		}
+	}
+	fmt.Printf("%d passed, %d failed\n", passed, failed)
+	return passed, failed, nil
+}
+
+// applyReplayConfig applies the settings of the capture's config file, if
+// any, to a copy of the configuration.
+func applyReplayConfig(path string) error {
+	data, err := os.ReadFile(path + replayConfigSuffix)
+	if os.IsNotExist(err) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	// Round-trip through JSON so that the overlay cannot modify the maps
+	// shared with the saved configuration.
+	current, err := json.Marshal(config)
+	if err != nil {
+		return err
+	}
+	var overlaid Config
+	if err := json.Unmarshal(current, &overlaid); err != nil {
+		return err
+	}
+	if err := json.Unmarshal(data, &overlaid); err != nil {
+		return fmt.Errorf("%s%s: %w", path, replayConfigSuffix, err)
+	}
+	config = overlaid
+	return nil
+}
+
+// replayCapture feeds a captured debug-events stream through the event
+// handlers from a clean state and returns the gesture keys it produced.
+func replayCapture(path string) ([]string, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	resetAllTouchState()
+	clear(touchpadSwipes)
+	clear(penStrokes)
+	recentGestures = nil
+	clear(heldButtons)
+	devices = make(map[string]deviceInfo)
+	lastExecutedAt, lastExecutedCount, lastExecutedKey, lastExecutedDevice = time.Time{}, 0, "", ""
+	clear(lastFiredAt)
+	armedKey = ""
+	keys := []string{}
+	replayedKeys = &keys
+	defer func() { replayedKeys = nil }()
+
+	scanner := bufio.NewScanner(f)
+	scanner.Buffer(make([]byte, 0, 64*1024), max(config.ScannerBufferSize, 64*1024))
+	for scanner.Scan() {
+		line := scanner.Text()
+		if matches := deviceAddedRegex.FindStringSubmatch(line); matches != nil && config.DetectDevices {
+			var capabilities []string
+			for _, c := range matches[2] {
+				if name, ok := deviceCapabilities[c]; ok {
+					capabilities = append(capabilities, name)
+				}
+			}
+			devices[matches[1]] = deviceInfo{capabilities: capabilities}
+			continue
+		}
+		eventMu.Lock()
+		processLine(line)
+		eventMu.Unlock()
+	}
+	eventMu.Lock()
+	forEachTouchDevice(flushCompletion)
+	flushTaps()
+	eventMu.Unlock()
+	return keys, scanner.Err()
+}
+
+// diffLines returns a minimal line diff turning want into got, with lines
+// prefixed by "-" (missing), "+" (unexpected) or " " (matching).
+func diffLines(want, got []string) []string {
+	// lcs[i][j] is the length of the longest common subsequence of want[i:]
+	// and got[j:].
+	lcs := make([][]int, len(want)+1)
+	for i := range lcs {
+		lcs[i] = make([]int, len(got)+1)
+	}
+	for i := len(want) - 1; i >= 0; i-- {
+		for j := len(got) - 1; j >= 0; j-- {
+			if want[i] == got[j] {
+				lcs[i][j] = lcs[i+1][j+1] + 1
+			} else {
+				lcs[i][j] = max(lcs[i+1][j], lcs[i][j+1])
+			}
+		}
+	}
+	var diff []string
+	i, j := 0, 0
+	for i < len(want) || j < len(got) {
+		switch {
+		case i < len(want) && j < len(got) && want[i] == got[j]:
+			diff = append(diff, "  "+want[i])
+			i++
+			j++
+		case i < len(want) && (j == len(got) || lcs[i+1][j] >= lcs[i][j+1]):
+			diff = append(diff, "- "+want[i])
+			i++
+		default:
+			diff = append(diff, "+ "+got[j])
+			j++
+		}
+	}
+	return diff
+}
+
+// ------------------ Learning Mode ------------------
+
+// learningSample is one completed interaction recorded in learning mode.
+type learningSample struct {
+	fingers  int
+	travel   float64
+	duration float64
+}
+
+var (
+	// learningMu guards learningSamples, which is read by the signal handler.
+	learningMu      sync.Mutex
+	learningSamples []learningSample
+)
+
+// recordSample stores a completed interaction for the learning report.
+func recordSample(fingers int, travel, duration float64) {
+	learningMu.Lock()
+	defer learningMu.Unlock()
+	learningSamples = append(learningSamples, learningSample{fingers, travel, duration})
+}
+
+// reportLearning logs statistics about the interactions recorded in learning
+// mode together with recommended threshold and maxGestureDurationMs values,
+// and writes them as a config snippet to LearningOutput if configured.
+//
+// Intentional swipes travel much further than accidental brushes, so the
+// recommended threshold is placed in the widest (relative) gap between
+// consecutive travel distances. The duration limit allows 1.5 times the 95th
+// percentile duration of the interactions above that threshold.
+func reportLearning() {
+	cfg := liveConfig()
+	if !cfg.LearningMode {
+		return
+	}
+	learningMu.Lock()
+	samples := slices.Clone(learningSamples)
+	learningMu.Unlock()
+
+	if len(samples) < 5 {
+		Log("info", fmt.Sprintf("Learning mode: only %d sample(s) recorded, need at least 5 for a recommendation", len(samples)))
+		return
+	}
+
+	fingers := make(map[int]int)
+	for _, s := range samples {
+		fingers[s.fingers]++
+	}
+	counts := slices.Sorted(maps.Keys(fingers))
+	var histogram []string
+	for _, n := range counts {
+		histogram = append(histogram, fmt.Sprintf("%d finger(s): %d", n, fingers[n]))
+	}
+	Log("info", fmt.Sprintf("Learning mode: %d samples (%s)", len(samples), strings.Join(histogram, ", ")))
+
+	slices.SortFunc(samples, func(a, b learningSample) int { return cmp.Compare(a.travel, b.travel) })
+	threshold := cfg.Threshold
+	bestGap := 0.0
+	for i := 0; i+1 < len(samples); i++ {
+		low, high := math.Max(samples[i].travel, 0.1), samples[i+1].travel
+		if gap := high / low; gap > bestGap {
+			bestGap = gap
+			threshold = math.Sqrt(low * high)
+		}
+	}
+	Log("info", fmt.Sprintf("Learning mode: travel min=%s median=%s max=%s",
+		formatFloat(samples[0].travel), formatFloat(samples[len(samples)/2].travel), formatFloat(samples[len(samples)-1].travel)))
+
+	var durations []float64
+	for _, s := range samples {
+		if s.travel >= threshold {
+			durations = append(durations, s.duration)
+		}
+	}
+	slices.Sort(durations)
+	maxDurationMs := 0
+	if len(durations) > 0 {
+		p95 := durations[(len(durations)-1)*95/100]
+		maxDurationMs = int(math.Ceil(p95 * 1.5 * 1000))
+	}
+	Log("info", fmt.Sprintf("Learning mode: recommended threshold=%s maxGestureDurationMs=%d", formatFloat(threshold), maxDurationMs))
+
+	if cfg.LearningOutput == "" {
+		return
+	}
+	snippet, _ := json.MarshalIndent(map[string]any{
+		"threshold":            math.Round(threshold*100) / 100,
+		"maxGestureDurationMs": maxDurationMs,
+	}, "", "  ")
+	if err := os.WriteFile(cfg.LearningOutput, append(snippet, '\n'), 0644); err != nil {
+		Log("error", fmt.Sprintf("Error writing learning output %s: %v", cfg.LearningOutput, err))
+		return
+	}
+	Log("info", fmt.Sprintf("Learning mode: suggested config written to %s", cfg.LearningOutput))
+}
+
+// ------------------ Gesture Context ------------------
+
+// Gesture describes a recognized gesture. Its fields are available to actions
+// as {placeholders} in the command and as FFGESTURE_* environment variables.
+type Gesture struct {
+	Key       string  `json:"key"`
+	Type      string  `json:"type"`
+	Count     int     `json:"count"`
+	Direction string  `json:"direction"`
+	Dx        float64 `json:"dx"`
+	Dy        float64 `json:"dy"`
+	// StartX/StartY and EndX/EndY are the centroid of the fingers at the
+	// start and end of the gesture, in device coordinates (0-100), or the pen
+	// position in millimeters for pen strokes.
+	StartX float64 `json:"startX"`
+	StartY float64 `json:"startY"`
+	EndX   float64 `json:"endX"`
+	EndY   float64 `json:"endY"`
+	// Scale and Angle describe pinch and rotate gestures: the change in
+	// finger spread and the rotation in degrees (clockwise positive).
+	Scale float64 `json:"scale,omitempty"`
+	Angle float64 `json:"angle,omitempty"`
+	// Pressure is the peak pen pressure (0-1) of a pen stroke.
+	Pressure float64 `json:"pressure,omitempty"`
+	// lastInputAt is the estimated wall-clock time of the last input event
+	// before the gesture was detected at detectedAt, for LogLatency.
+	lastInputAt, detectedAt time.Time
+	// rawLines are the debug-events lines the gesture was detected from,
+	// for RawLinesPath.
+	rawLines []string
+	// Taps is the number of chained taps of a tap gesture.
+	Taps int `json:"taps,omitempty"`
+	// Speed is the swipe's travel per second and Zone its SpeedZones band,
+	// when SpeedZones is set.
+	Speed float64 `json:"speed,omitempty"`
+	Zone  string  `json:"zone,omitempty"`
+	// Fingers lists the fingers left to right when FingerPositions is set.
+	Fingers []FingerPosition `json:"fingers,omitempty"`
+}
+
+// FingerPosition is where a finger of a gesture landed and how far it moved.
+type FingerPosition struct {
+	X  float64 `json:"x"`
+	Y  float64 `json:"y"`
+	Dx float64 `json:"dx"`
+	Dy float64 `json:"dy"`
+}
+
+// fingerPositions returns the touches ordered left to right by where they
+// landed, then top to bottom.
+func fingerPositions(touches []*TouchPoint) []FingerPosition {
+	fingers := make([]FingerPosition, 0, len(touches))
+	for _, tp := range touches {
+		fingers = append(fingers, FingerPosition{X: tp.startX, Y: tp.startY, Dx: tp.lastX - tp.startX, Dy: tp.lastY - tp.startY})
+	}
+	slices.SortStableFunc(fingers, func(a, b FingerPosition) int {
+		return cmp.Or(cmp.Compare(a.X, b.X), cmp.Compare(a.Y, b.Y))
+	})
+	return fingers
+}
+
+// templateRegex matches {name} placeholders in commands.
+var templateRegex = regexp.MustCompile(`\{(\w+)\}`)
+
+// fields returns the template fields describing g.
+func (g Gesture) fields() map[string]string {
+	fields := map[string]string{
+		"key":   g.Key,
+		"type":  g.Type,
+		"count": strconv.Itoa(g.Count),
+		"dir":   g.Direction,
+		"dx":    formatFloat(g.Dx),
+		"dy":    formatFloat(g.Dy),
+	}
+	if g.Type == "pinch" || g.Type == "rotate" {
+		fields["scale"] = formatFloat(g.Scale)
+		fields["angle"] = formatFloat(g.Angle)
+	}
+	if g.Type == "pen" {
+		fields["pressure"] = formatFloat(g.Pressure)
+	}
+	if g.Type == "tap" {
+		fields["taps"] = strconv.Itoa(g.Taps)
+	}
+	if g.Zone != "" {
+		fields["speed"] = formatFloat(g.Speed)
+		fields["zone"] = g.Zone
+	}
+	for i, f := range g.Fingers {
+		prefix := fmt.Sprintf("finger%d_", i)
+		fields[prefix+"x"] = formatFloat(f.X)
+		fields[prefix+"y"] = formatFloat(f.Y)
+		fields[prefix+"dx"] = formatFloat(f.Dx)
+		fields[prefix+"dy"] = formatFloat(f.Dy)
+	}
+	if m := liveConfig().ScreenMapping; m != nil {
+		fields["screen_start_x"] = formatFloat(m.OffsetX + g.StartX*m.ScaleX)
+		fields["screen_start_y"] = formatFloat(m.OffsetY + g.StartY*m.ScaleY)
+		fields["screen_end_x"] = formatFloat(m.OffsetX + g.EndX*m.ScaleX)
+		fields["screen_end_y"] = formatFloat(m.OffsetY + g.EndY*m.ScaleY)
+	}
+	return fields
+}
+
+// environ returns the fields of g as FFGESTURE_<NAME>=value pairs.
+func (g Gesture) environ() []string {
+	var env []string
+	for name, value := range g.fields() {
+		env = append(env, "FFGESTURE_"+strings.ToUpper(name)+"="+value)
+	}
+	sort.Strings(env)
+	return env
+}
+
+// expandTemplate replaces {name} placeholders in s with the matching value
+// from fields. Unknown placeholders are left untouched.
+func expandTemplate(s string, fields map[string]string) string {
+	return templateRegex.ReplaceAllStringFunc(s, func(m string) string {
+		if value, ok := fields[m[1:len(m)-1]]; ok {
+			return value
+		}
+		return m
+	})
+}
+
+// ------------------ Process Inhibition ------------------
+
+// inhibitCacheTTL is how long the result of a process scan is reused.
+const inhibitCacheTTL = 2 * time.Second
+
+var (
+	// inhibitCheckedAt is when the running processes were last scanned.
+	inhibitCheckedAt time.Time
+	// inhibitRunning is the cached name of the inhibiting process, if any.
+	inhibitRunning string
+)
+
+// inhibitingProcess returns the name of a running process listed in
+// config.InhibitWhenRunning, or "" if none is running. The result is cached
+// for inhibitCacheTTL to avoid scanning processes on every gesture.
+func inhibitingProcess() string {
+	if len(config.InhibitWhenRunning) == 0 {
+		return ""
+	}
+	if time.Since(inhibitCheckedAt) < inhibitCacheTTL {
+		return inhibitRunning
+	}
+	inhibitRunning = findRunningProcess(config.InhibitWhenRunning)
+	inhibitCheckedAt = time.Now()
+	return inhibitRunning
+}
+
+// lockCheckTimeout bounds LockStateCommand, which runs while gestures are
+// dispatched.
+const lockCheckTimeout = time.Second
+
+var (
+	// lockCheckedAt is when LockStateCommand was last run.
+	lockCheckedAt time.Time
+	// lockState is its cached result.
+	lockState bool
+	// lockCheckFailing is set while LockStateCommand keeps failing, so that
+	// only the first failure is warned about.
+	lockCheckFailing bool
+)
+
+// screenLocked reports whether LockStateCommand says the screen is locked.
+// The result is cached for inhibitCacheTTL; a failing command counts as
+// unlocked.
+func screenLocked() bool {
+	if time.Since(lockCheckedAt) < inhibitCacheTTL {
+		return lockState
+	}
+	lockCheckedAt = time.Now()
+	ctx, cancel := context.WithTimeout(context.Background(), lockCheckTimeout)
+	defer cancel()
+	cmd := exec.CommandContext(ctx, "sh", "-c", config.LockStateCommand)
+	// Kill the whole process group so that children of "sh -c" do not keep
+	// its output open.
+	cmd.SysProcAttr = &syscall.SysProcAttr{Setpgid: true}
+	cmd.Cancel = func() error { return syscall.Kill(-cmd.Process.Pid, syscall.SIGKILL) }
+	output, err := cmd.Output()
+	if err != nil {
+		if lockCheckFailing {
+			Log("debug", fmt.Sprintf("Lock state command failed, assuming unlocked: %v", err))
+		} else {
+			Log("warn", fmt.Sprintf("Lock state command failed, assuming unlocked until it succeeds: %v", err))
+		}
+		lockCheckFailing = true
+		lockState = false
+		return false
+	}
+	lockCheckFailing = false
+	switch strings.ToLower(strings.TrimSpace(string(output))) {
+	case "locked", "yes", "true", "1":
+		lockState = true
+	default:
+		lockState = false
+	}
+	return lockState
+}
+
+// findRunningProcess scans /proc for a process whose command name matches one
+// of names. When /proc is not mounted (the default on FreeBSD) it falls back
+// to pgrep.
+func findRunningProcess(names []string) string {
+	if entries, err := os.ReadDir("/proc"); err == nil {
+		sawProcess := false
+		for _, e := range entries {
+			if _, err := strconv.Atoi(e.Name()); err != nil {
+				continue
+			}
+			data, err := os.ReadFile("/proc/" + e.Name() + "/comm")
+			if err != nil {
+				continue
+			}
+			sawProcess = true
+			comm := strings.TrimSpace(string(data))
+			for _, name := range names {
+				// Linux truncates comm to 15 characters.
+				if comm == name || (len(name) > 15 && comm == name[:15]) {
+					return name
+				}
+			}
+		}
+		if sawProcess {
+			return ""
+		}
+	}
+	for _, name := range names {
+		if exec.Command("pgrep", "-x", name).Run() == nil {
+			return name
+		}
+	}
+	return ""
+}
+
+// playSound plays the given sound file with the configured SoundPlayer.
+// Failures, including a missing player, are only logged.
+func playSound(path string) {
+	args := strings.Fields(liveConfig().SoundPlayer)
+	if len(args) == 0 {
+		return
+	}
+	if _, err := exec.LookPath(args[0]); err != nil {
+		Log("warn", fmt.Sprintf("Sound player %s not found, cannot play %s", args[0], path))
+		return
+	}
+	if output, err := exec.Command(args[0], append(args[1:], path)...).CombinedOutput(); err != nil {
+		Log("warn", fmt.Sprintf("Error playing sound %s: %v\nOutput: %s", path, err, strings.TrimSpace(string(output))))
+	}
+}
+
+// executeCommand runs the action's command, or each of its Commands in turn
+// subject to their conditions.
+func executeCommand(action Action, g Gesture) {
+	if liveConfig().LogLatency && !g.lastInputAt.IsZero() {
+		Log("debug", fmt.Sprintf("Latency of %s: %s from the last input event to the command, %s of it until detection",
+			g.Key, time.Since(g.lastInputAt).Round(time.Microsecond), g.detectedAt.Sub(g.lastInputAt).Round(time.Microsecond)))
+	}
+	if action.Sound != "" {
+		go playSound(action.Sound)
+	}
+	if len(action.Commands) == 0 {
+		runCommand(action.Command, time.Duration(action.TimeoutMs)*time.Millisecond, action, g)
+		return
+	}
+	var err error
+	for i, step := range action.Commands {
+		if (step.When == "onSuccess" && err != nil) || (step.When == "onFailure" && err == nil) {
+			Log("debug", fmt.Sprintf("Skipping step %d (%s)", i+1, step.When))
+			continue
+		}
+		err = runStep(step, action, g)
+	}
+}
+
+// runStep performs one sub-action of a composite action.
+func runStep(step Step, action Action, g Gesture) error {
+	cfg := liveConfig()
+	timeout := time.Duration(step.TimeoutMs) * time.Millisecond
+	fields := g.fields()
+	switch step.Type {
+	case "", "shell":
+		return runCommand(step.Command, timeout, action, g)
+	case "dbus":
+		argv := []string{"dbus-send", "--session", "--type=method_call", "--print-reply",
+			"--dest=" + step.Dest, step.Path, step.Method}
+		for _, arg := range step.Args {
+			argv = append(argv, expandTemplate(arg, fields))
+		}
+		return runProcess(strings.Join(argv, " "), argv, timeout, action, g)
+	case "key":
+		if cfg.keyToolErr != nil {
+			if step.Command == "" {
+				err := fmt.Errorf("cannot send %s, key injection is unavailable: %v", step.Keys, cfg.keyToolErr)
+				Log("error", err.Error())
+				return err
+			}
+			Log("info", fmt.Sprintf("Key injection is unavailable, running the step's command instead of sending %s", step.Keys))
+			return runCommand(step.Command, timeout, action, g)
+		}
+		argv := append(strings.Fields(cfg.KeyTool), expandTemplate(step.Keys, fields))
+		return runProcess(strings.Join(argv, " "), argv, timeout, action, g)
+	case "sound":
+		argv := append(strings.Fields(cfg.SoundPlayer), step.Sound)
+		return runProcess(strings.Join(argv, " "), argv, timeout, Action{}, g)
+	default:
+		return fmt.Errorf("unknown step type %q", step.Type)
+	}
+}
+
+// runCommand runs a shell command using "sh -c". Placeholders such as {dx}
+// are expanded from g.
+func runCommand(command string, timeout time.Duration, action Action, g Gesture) error {
+	command = expandTemplate(command, g.fields())
+	return runProcess(command, []string{"sh", "-c", command}, timeout, action, g)
+}
+
+// runProcess runs argv and logs its output, describing it as desc. The
+// gesture is exposed through FFGESTURE_* variables and the process inherits
+// the environment so that variables like XDG_RUNTIME_DIR are preserved, with
+// action.Env applied on top. The exit status and duration of every attempt
+// are logged with the gesture key. A failing process is re-run up to
+// action.RetryCount times, RetryDelayMs apart, and the last error is
+// returned. A non-zero timeout covers all attempts together: the running one
+// is killed and no further ones are made once it expires.
+func runProcess(desc string, argv []string, timeout time.Duration, action Action, g Gesture) error {
+	ctx, cancel := context.Background(), func() {}
+	if timeout > 0 {
+		ctx, cancel = context.WithTimeout(ctx, timeout)
+	}
+	defer cancel()
+	for attempt := 0; ; attempt++ {
+		if attempt == 0 {
+			Log("info", fmt.Sprintf("Executing command: %s", desc))
+		} else {
+			Log("info", fmt.Sprintf("Retrying command (attempt %d/%d): %s", attempt+1, action.RetryCount+1, desc))
+		}
+		cmd := exec.CommandContext(ctx, argv[0], argv[1:]...)
+		cmd.Env = append(os.Environ(), g.environ()...)
+		for name, value := range action.Env {
+			cmd.Env = append(cmd.Env, name+"="+value)
+		}
+		if timeout > 0 {
+			// Kill the whole process group so that children of "sh -c"
+			// do not outlive the timeout.
+			cmd.SysProcAttr = &syscall.SysProcAttr{Setpgid: true}
+			cmd.Cancel = func() error { return syscall.Kill(-cmd.Process.Pid, syscall.SIGKILL) }
+			cmd.WaitDelay = time.Second
+		}
+		started := time.Now()
+		output, err := cmd.CombinedOutput()
+		elapsed := time.Since(started).Round(time.Millisecond)
+		if ctx.Err() == context.DeadlineExceeded {
+			err = fmt.Errorf("timed out after %s", timeout)
+		}
+		if cmd.ProcessState != nil {
+			Log("info", fmt.Sprintf("Command for %s exited with status %d after %s", cmp.Or(g.Key, desc), cmd.ProcessState.ExitCode(), elapsed))
+		}
+		if err == nil {
+			Log("debug", fmt.Sprintf("Command output: %s", strings.TrimSpace(string(output))))
+			return nil
+		}
+		Log("error", fmt.Sprintf("Error executing command: %v\nOutput: %s", err, strings.TrimSpace(string(output))))
+		if attempt >= action.RetryCount || ctx.Err() != nil {
+			return err
+		}
+		select {
+		case <-time.After(time.Duration(action.RetryDelayMs) * time.Millisecond):
+		case <-ctx.Done():
+			Log("error", fmt.Sprintf("Giving up on command after %s: %s", timeout, desc))
+			return fmt.Errorf("timed out after %s", timeout)
+		}
 	}
 }
@@ -0,0 +1,79 @@
+package main
+
+import (
+	"io"
+	"os"
+	"slices"
+	"testing"
+)
+
+func TestMain(m *testing.M) {
+	logOutput = io.Discard
+	validateConfig()
+	os.Exit(m.Run())
+}
+
+// TestReplay checks the captures in testdata/replay against their expected
+// gestures.
+func TestReplay(t *testing.T) {
+	passed, failed, err := runReplay("testdata/replay")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if failed > 0 {
+		t.Errorf("%d of %d replay checks failed", failed, passed+failed)
+	}
+}
+
+// TestTapBoundary checks that touches moving less than the threshold are taps
+// when lifted within tapMaxMs and are ignored otherwise.
+func TestTapBoundary(t *testing.T) {
+	tests := []struct {
+		name     string
+		tapMaxMs int
+		moved    float64
+		lifetime float64
+		want     []string
+	}{
+		{"quick lift", 200, 2, 0.1, []string{"2tap"}},
+		{"lift at tapMaxMs", 200, 2, 0.2, []string{"2tap"}},
+		{"lift after tapMaxMs", 200, 2, 0.25, []string{}},
+		{"taps disabled", 0, 2, 0.1, []string{}},
+		{"above threshold", 200, 30, 0.1, []string{"2swipe_up"}},
+	}
+	saved := config
+	defer func() {
+		config = saved
+		publishConfig()
+	}()
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			config = saved
+			config.Threshold = 10
+			config.TapMaxMs = tt.tapMaxMs
+			config.MultiTapWindowMs = 0
+			publishConfig()
+			resetTouchState()
+			keys := []string{}
+			replayedKeys = &keys
+			defer func() { replayedKeys = nil }()
+
+			var touches []*TouchPoint
+			for id, x := range []float64{40, 60} {
+				touches = append(touches, &TouchPoint{
+					id:     id,
+					startX: x, startY: 50,
+					lastX: x, lastY: 50 - tt.moved,
+					lastTime: tt.lifetime, liftTime: tt.lifetime,
+					samples: 5,
+				})
+			}
+			eventMu.Lock()
+			processGesture(touches)
+			eventMu.Unlock()
+			if !slices.Equal(keys, tt.want) {
+				t.Errorf("got %v, want %v", keys, tt.want)
+			}
+		})
+	}
+}